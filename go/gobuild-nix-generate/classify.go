@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/adisbladis/gobuild.nix/go/gobuild-nix-generate/lockfile"
+	"golang.org/x/sync/errgroup"
+)
+
+// List the GOOS/GOARCH pairs supported by the Go toolchain
+func listPlatforms() ([]string, error) {
+	cmd := exec.Command("go", "tool", "dist", "list")
+	stdout, err := cmd.Output()
+	if err != nil {
+		if exiterr, ok := err.(*exec.ExitError); ok {
+			return nil, fmt.Errorf("failed to run 'go tool dist list': %s\n%s", exiterr, exiterr.Stderr)
+		}
+		return nil, fmt.Errorf("failed to run 'go tool dist list': %s", err)
+	}
+
+	return strings.Fields(string(stdout)), nil
+}
+
+// List the modules providing the import closure of patterns in the main module for a single platform
+func listDepModules(directory string, platform string, args ...string) (map[string]bool, error) {
+	modules := make(map[string]bool)
+
+	goos, goarch, _ := strings.Cut(platform, "/")
+
+	cmd := exec.Command("go", append([]string{"list", "-e", "-deps", "-f", "{{with .Module}}{{.Path}}{{end}}"}, args...)...)
+	cmd.Dir = directory
+	// Cgo is disabled by default when cross compiling, but files importing C are part of native builds
+	cmd.Env = append(os.Environ(), "GOOS="+goos, "GOARCH="+goarch, "CGO_ENABLED=1")
+	stdout, err := cmd.Output()
+	if err != nil {
+		if exiterr, ok := err.(*exec.ExitError); ok {
+			return nil, fmt.Errorf("failed to run 'go list' for %s: %s\n%s", platform, exiterr, exiterr.Stderr)
+		}
+		return nil, fmt.Errorf("failed to run 'go list' for %s: %s", platform, err)
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(stdout))
+	for scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			modules[line] = true
+		}
+	}
+
+	return modules, scanner.Err()
+}
+
+// List the modules providing the import closure of patterns on any of the platforms
+func listAllDepModules(directory string, platforms []string, args ...string) (map[string]bool, error) {
+	var mux sync.Mutex
+	modules := make(map[string]bool)
+
+	eg := errgroup.Group{}
+	eg.SetLimit(runtime.NumCPU())
+	for _, platform := range platforms {
+		eg.Go(func() error {
+			platformModules, err := listDepModules(directory, platform, args...)
+			if err != nil {
+				return err
+			}
+
+			mux.Lock()
+			defer mux.Unlock()
+			for goPackagePath := range platformModules {
+				modules[goPackagePath] = true
+			}
+
+			return nil
+		})
+	}
+
+	return modules, eg.Wait()
+}
+
+// Classify locked modules by how the main module uses them.
+//
+// Modules in the import closure of the main module's packages are build dependencies.
+// Modules only in the closure of tool directives are tools & those only reached through the main module's tests are test dependencies.
+// Modules not imported at all are only in the module graph, they're conservatively classified as build dependencies.
+//
+// Import closures are the union over all platforms supported by Go,
+// so a module imported only on another platform than the one generating the lock is still a build dependency.
+func classifyModules(directory string, lock *lockfile.Lock) error {
+	log.Println("Classifying dependencies")
+
+	platforms, err := listPlatforms()
+	if err != nil {
+		return err
+	}
+
+	build, err := listAllDepModules(directory, platforms, "./...")
+	if err != nil {
+		return err
+	}
+
+	test, err := listAllDepModules(directory, platforms, "-test", "./...")
+	if err != nil {
+		return err
+	}
+
+	tool := make(map[string]bool)
+	if len(lock.Tools) > 0 {
+		tool, err = listAllDepModules(directory, platforms, "tool")
+		if err != nil {
+			return err
+		}
+	}
+
+	for goPackagePath, locked := range lock.Locked {
+		switch {
+		case build[goPackagePath]:
+			locked.Usage = lockfile.UsageBuild
+		case tool[goPackagePath]:
+			locked.Usage = lockfile.UsageTool
+		case test[goPackagePath]:
+			locked.Usage = lockfile.UsageTest
+		default:
+			locked.Usage = lockfile.UsageBuild
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"runtime/debug"
+
+	"github.com/adisbladis/gobuild.nix/go/gobuild-nix-generate/lockfile"
+)
+
+// lockIdentity describes the environment hashes are computed in.
+// Hashes from locks with a different identity can't be reused.
+type lockIdentity struct {
+	Go        string
+	Fetcher   string
+	Generator string
+}
+
+// Evaluate the version of the Go attribute used for prefetching
+func evalGoVersion(pkgsFlag string, attrFlag string) (string, error) {
+	expr := fmt.Sprintf("(import %s { }).\"%s\".version", pkgsFlag, attrFlag)
+
+	cmd := exec.Command("nix-instantiate", "--eval", "--json", "--expr", expr)
+	output, err := cmd.Output()
+	if err != nil {
+		if exiterr, ok := err.(*exec.ExitError); ok {
+			return "", fmt.Errorf("failed to evaluate Go version: %s\n%s", exiterr, exiterr.Stderr)
+		}
+		return "", fmt.Errorf("failed to evaluate Go version: %w", err)
+	}
+
+	var version string
+	if err := json.Unmarshal(output, &version); err != nil {
+		return "", fmt.Errorf("failed to parse Go version: %w", err)
+	}
+
+	return version, nil
+}
+
+// Get the version of this generator from the embedded build info
+func generatorVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+
+	if info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.revision" {
+			return setting.Value
+		}
+	}
+
+	return "(devel)"
+}
+
+func newLockIdentity(pkgsFlag string, attrFlag string) (*lockIdentity, error) {
+	goVersion, err := evalGoVersion(pkgsFlag, attrFlag)
+	if err != nil {
+		return nil, err
+	}
+
+	// Hashed like builtins.hashFile "sha256" in mkGoSet
+	fetcherHash := sha256.Sum256([]byte(fetcherExpr))
+
+	return &lockIdentity{
+		Go:        goVersion,
+		Fetcher:   hex.EncodeToString(fetcherHash[:]),
+		Generator: generatorVersion(),
+	}, nil
+}
+
+// Check whether hashes were computed with the same Go version & fetcher.
+// Locks without recorded identity predate it & are assumed to match.
+func (id *lockIdentity) matches(goVersion string, fetcher string) bool {
+	return (goVersion == "" || goVersion == id.Go) && (fetcher == "" || fetcher == id.Fetcher)
+}
+
+// Record the identity in the header of a lock
+func (id *lockIdentity) apply(lock *lockfile.Lock) {
+	lock.Go = id.Go
+	lock.Fetcher = id.Fetcher
+	lock.Generator = id.Generator
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/BurntSushi/toml"
+
+	"github.com/adisbladis/gobuild.nix/go/gobuild-nix-generate/lockfile"
+)
+
+// gomod2nixLock is the subset of gomod2nix.toml we need to import it
+type gomod2nixLock struct {
+	Schema int `toml:"schema"`
+	Mod    map[string]struct {
+		Version  string `toml:"version"`
+		Hash     string `toml:"hash"`
+		Replaced string `toml:"replaced"`
+	} `toml:"mod"`
+}
+
+// Read the pinned module versions from a gomod2nix.toml
+func readGomod2nixVersions(path string) (map[string]string, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", path, err)
+	}
+
+	lock := &gomod2nixLock{}
+	if err := toml.Unmarshal(contents, lock); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", path, err)
+	}
+
+	versions := make(map[string]string)
+	for goPackagePath, mod := range lock.Mod {
+		if mod.Replaced != "" {
+			return nil, fmt.Errorf("error importing %s: %s is replaced by %s, replaced modules are not supported", path, goPackagePath, mod.Replaced)
+		}
+		versions[goPackagePath] = mod.Version
+	}
+
+	return versions, nil
+}
+
+// Create a lock from an existing gomod2nix.toml.
+//
+// The hashes in gomod2nix.toml are for a different fetcher layout & can't be reused,
+// only the module versions are imported.
+// Requirements & cycles are resolved from the module's go.mod files like for a regular lock.
+func importGomod2nix(directory string, path string, pool *hashPool) (*lockfile.Lock, error) {
+	versions, err := readGomod2nixVersions(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Warn about gomod2nix.toml being out of sync with go.sum
+	sumVersions, err := readSumVersions(directory)
+	if err != nil {
+		return nil, err
+	}
+	for goPackagePath, version := range versions {
+		sumVersion, ok := sumVersions[goPackagePath]
+		if !ok {
+			log.Printf("Warning: %s is not in go.sum", goPackagePath)
+		} else if sumVersion != version {
+			log.Printf("Warning: %s is %s in go.sum but %s in %s", goPackagePath, sumVersion, version, path)
+		}
+	}
+
+	packages := make([]string, 0, len(versions))
+	for goPackagePath, version := range versions {
+		packages = append(packages, fmt.Sprintf("%s@%s", goPackagePath, version))
+	}
+	slices.Sort(packages)
+
+	log.Println("Discovering dependencies")
+	modDownloads, err := downloadModules(directory, packages)
+	if err != nil {
+		return nil, err
+	}
+	log.Println("Done discovering dependencies")
+
+	return createLock(directory, modDownloads, pool)
+}
+
+func importCmd(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	var fromFlag = flags.String("from", "gomod2nix", "format to import from (gomod2nix, vendorhash)")
+	var pkgsFlag = flags.String("f", "<nixpkgs>", "path to custom nixpkgs used for prefetching")
+	var jobsFlag = flags.Int("j", 10, "number of max concurrent prefetching jobs")
+	var attrFlag = flags.String("a", "go", "go attribute to use for prefetching")
+
+	flags.Parse(args)
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+
+	id, err := newLockIdentity(*pkgsFlag, *attrFlag)
+	if err != nil {
+		return err
+	}
+
+	prevHashes, err := readPrevHashes(filepath.Join(cwd, lockfile.FileName), id)
+	if err != nil {
+		return err
+	}
+
+	pool := newHashPool(*jobsFlag, *pkgsFlag, *attrFlag)
+	pool.seed(prevHashes)
+
+	var lock *lockfile.Lock
+	switch *fromFlag {
+	case "gomod2nix":
+		path := "gomod2nix.toml"
+		if flags.NArg() > 0 {
+			path = flags.Arg(0)
+		}
+
+		lock, err = importGomod2nix(cwd, path, pool)
+	case "vendorhash":
+		// A vendorHash is an opaque hash over all dependencies & carries no version information.
+		// The module versions of buildGoModule projects are defined entirely by go.mod/go.sum.
+		var modDownloads []*goModDownload
+		modDownloads, err = discoverModules(cwd)
+		if err != nil {
+			return err
+		}
+		lock, err = createLock(cwd, modDownloads, pool)
+	default:
+		return fmt.Errorf("unknown import format: %s", *fromFlag)
+	}
+	if err != nil {
+		return err
+	}
+
+	id.apply(lock)
+
+	if err := lock.Save(lockfile.FileName); err != nil {
+		return err
+	}
+	log.Printf("Wrote %s", lockfile.FileName)
+
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadGomod2nixVersions(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		contents string
+		want     map[string]string
+		err      string
+	}{
+		{
+			name: "modules",
+			contents: `schema = 3
+
+[mod]
+  [mod."github.com/BurntSushi/toml"]
+    version = "v1.5.0"
+    hash = "sha256-SyKVqkZQopsYprjWCVssulTGQ/NUrrztdzsl02Bsg7Q="
+  [mod."golang.org/x/mod"]
+    version = "v0.30.0"
+    hash = "sha256-dEjRvA/ak+JgGyfQ3jzMc/uiznogPtqv2j+C6xJASqU="
+`,
+			want: map[string]string{
+				"github.com/BurntSushi/toml": "v1.5.0",
+				"golang.org/x/mod":           "v0.30.0",
+			},
+		},
+		{
+			name:     "no modules",
+			contents: "schema = 3\n",
+			want:     map[string]string{},
+		},
+		{
+			name: "replaced",
+			contents: `schema = 3
+
+[mod]
+  [mod."golang.org/x/mod"]
+    version = "v0.30.0"
+    hash = "sha256-dEjRvA/ak+JgGyfQ3jzMc/uiznogPtqv2j+C6xJASqU="
+  [mod."example.com/fork"]
+    version = "v1.0.0"
+    hash = "sha256-dEjRvA/ak+JgGyfQ3jzMc/uiznogPtqv2j+C6xJASqU="
+    replaced = "github.com/someone/fork"
+`,
+			err: "example.com/fork is replaced by github.com/someone/fork",
+		},
+		{
+			name:     "invalid toml",
+			contents: "[mod\n",
+			err:      "error parsing",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "gomod2nix.toml")
+			if err := os.WriteFile(path, []byte(tt.contents), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := readGomod2nixVersions(path)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("readGomod2nixVersions() = %v, %v, want an error containing %q", got, err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("readGomod2nixVersions() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := readGomod2nixVersions(filepath.Join(t.TempDir(), "missing.toml")); err == nil || !strings.Contains(err.Error(), "error reading") {
+		t.Errorf("readGomod2nixVersions() of missing file = %v, want a read error", err)
+	}
+}
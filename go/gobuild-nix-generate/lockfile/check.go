@@ -0,0 +1,199 @@
+package lockfile
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+// Problem is a single inconsistency found in a lock
+type Problem struct {
+	// The module the problem was found in, empty for lock-wide problems
+	Module  string
+	Message string
+}
+
+func (p *Problem) Error() string {
+	if p.Module == "" {
+		return p.Message
+	}
+	return fmt.Sprintf("%s: %s", p.Module, p.Message)
+}
+
+// Digest sizes of hash algorithms accepted in SRI hashes
+var sriDigestSizes = map[string]int{
+	"sha1":   20,
+	"sha256": 32,
+	"sha512": 64,
+}
+
+// CheckHash validates that hash is a well formed SRI hash
+func CheckHash(hash string) error {
+	if hash == "" {
+		return fmt.Errorf("hash is empty")
+	}
+
+	algo, digest, ok := strings.Cut(hash, "-")
+	if !ok {
+		return fmt.Errorf("hash '%s' is not in SRI format", hash)
+	}
+
+	size, ok := sriDigestSizes[algo]
+	if !ok {
+		return fmt.Errorf("hash '%s' has unsupported algorithm '%s'", hash, algo)
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(digest)
+	if err != nil {
+		return fmt.Errorf("hash '%s' has invalid base64 digest: %w", hash, err)
+	}
+	if len(decoded) != size {
+		return fmt.Errorf("hash '%s' has a %d byte digest, expected %d for %s", hash, len(decoded), size, algo)
+	}
+
+	return nil
+}
+
+// Check verifies all invariants that a generated lock guarantees.
+//
+// Unlike Validate which only checks that a lock is loadable,
+// this also checks module paths, versions, hashes, requirements & that recorded cycles are the actual dependency cycles.
+// Problems are returned in a stable order.
+func (l *Lock) Check() []*Problem {
+	var problems []*Problem
+	report := func(goPackagePath string, format string, a ...any) {
+		problems = append(problems, &Problem{
+			Module:  goPackagePath,
+			Message: fmt.Sprintf(format, a...),
+		})
+	}
+
+	if l.Schema != SchemaVersion {
+		report("", "unsupported schema version %d, expected %d", l.Schema, SchemaVersion)
+	}
+
+	if l.Locked == nil {
+		report("", "lock has no locked table")
+	}
+
+	if l.Fetcher != "" {
+		if digest, err := hex.DecodeString(l.Fetcher); err != nil || len(digest) != 32 {
+			report("", "fetcher hash '%s' is not a hex encoded SHA-256 digest", l.Fetcher)
+		}
+	}
+
+	for _, goPackagePath := range slices.Sorted(maps.Keys(l.Locked)) {
+		locked := l.Locked[goPackagePath]
+		if locked == nil {
+			report(goPackagePath, "lock entry is empty")
+			continue
+		}
+
+		if err := module.CheckPath(goPackagePath); err != nil {
+			report(goPackagePath, "invalid module path: %v", err)
+		}
+
+		if !semver.IsValid(locked.Version) {
+			report(goPackagePath, "invalid version '%s'", locked.Version)
+		} else if err := module.Check(goPackagePath, locked.Version); err != nil {
+			report(goPackagePath, "version doesn't match module path: %v", err)
+		}
+
+		if err := CheckHash(locked.Hash); err != nil {
+			report(goPackagePath, "%v", err)
+		}
+
+		switch locked.Usage {
+		case UsageBuild, UsageTest, UsageTool:
+		default:
+			report(goPackagePath, "invalid usage '%s'", locked.Usage)
+		}
+
+		seen := make(map[string]bool)
+		for _, req := range locked.Require {
+			if seen[req] {
+				report(goPackagePath, "duplicate requirement '%s'", req)
+				continue
+			}
+			seen[req] = true
+
+			if req == goPackagePath {
+				report(goPackagePath, "requires itself")
+			} else if _, ok := l.Locked[req]; !ok {
+				report(goPackagePath, "requires '%s' which is not locked", req)
+			}
+		}
+	}
+
+	for _, toolPath := range slices.Sorted(maps.Keys(l.Tools)) {
+		goPackagePath := l.Tools[toolPath]
+		if _, ok := l.Locked[goPackagePath]; !ok {
+			report(goPackagePath, "provides tool '%s' but is not locked", toolPath)
+		} else if toolPath != goPackagePath && !strings.HasPrefix(toolPath, goPackagePath+"/") {
+			report(goPackagePath, "provides tool '%s' which is not in the module", toolPath)
+		}
+	}
+
+	problems = append(problems, l.checkCycles()...)
+
+	return problems
+}
+
+// Compare the recorded cycle groups against the strongly connected components of the dependency graph
+func (l *Lock) checkCycles() []*Problem {
+	var problems []*Problem
+	report := func(goPackagePath string, format string, a ...any) {
+		problems = append(problems, &Problem{
+			Module:  goPackagePath,
+			Message: fmt.Sprintf(format, a...),
+		})
+	}
+
+	for _, goPackagePath := range slices.Sorted(maps.Keys(l.Cycles)) {
+		if _, ok := l.Locked[goPackagePath]; !ok {
+			report(goPackagePath, "is in cycle group %d but not locked", l.Cycles[goPackagePath])
+		}
+	}
+
+	// Actual cycle of each module
+	actual := make(map[string][]string)
+	for _, cycle := range l.FindCycles() {
+		for _, goPackagePath := range cycle {
+			actual[goPackagePath] = cycle
+		}
+	}
+
+	groups := l.CycleGroups()
+	for _, idx := range slices.Sorted(maps.Keys(groups)) {
+		members := groups[idx]
+
+		if len(members) < 2 {
+			report(members[0], "is the only member of cycle group %d", idx)
+			continue
+		}
+
+		cycle, ok := actual[members[0]]
+		if !ok {
+			report("", "cycle group %d (%s) is not a dependency cycle", idx, strings.Join(members, ", "))
+			continue
+		}
+
+		if !slices.Equal(cycle, members) {
+			report("", "cycle group %d (%s) doesn't match dependency cycle (%s)", idx, strings.Join(members, ", "), strings.Join(cycle, ", "))
+		}
+	}
+
+	for _, goPackagePath := range slices.Sorted(maps.Keys(actual)) {
+		if _, ok := l.Cycles[goPackagePath]; !ok {
+			report(goPackagePath, "is part of dependency cycle (%s) but not in any cycle group", strings.Join(actual[goPackagePath], ", "))
+		}
+	}
+
+	return problems
+}
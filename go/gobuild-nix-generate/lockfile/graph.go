@@ -0,0 +1,144 @@
+package lockfile
+
+import (
+	"slices"
+	"sort"
+)
+
+// FindCycles returns all dependency cycles in the lock.
+// Each cycle is a sorted list of the modules in a strongly connected component.
+func (l *Lock) FindCycles() [][]string {
+	var cycles [][]string
+	for _, scc := range findStronglyConnectedComponents(l.Locked) {
+		if len(scc) > 1 {
+			sort.Strings(scc)
+			cycles = append(cycles, scc)
+		}
+	}
+
+	// Sort cycles for stable group indices
+	slices.SortFunc(cycles, func(a, b []string) int {
+		return slices.Compare(a, b)
+	})
+
+	return cycles
+}
+
+// SetCycles recomputes the cycle groups of the lock
+func (l *Lock) SetCycles() {
+	l.Cycles = make(map[string]int)
+	for i, cycle := range l.FindCycles() {
+		for _, goPackagePath := range cycle {
+			l.Cycles[goPackagePath] = i
+		}
+	}
+}
+
+// CycleGroups returns the recorded cycle groups by index with sorted members
+func (l *Lock) CycleGroups() map[int][]string {
+	groups := make(map[int][]string)
+	for goPackagePath, idx := range l.Cycles {
+		groups[idx] = append(groups[idx], goPackagePath)
+	}
+	for _, members := range groups {
+		slices.Sort(members)
+	}
+	return groups
+}
+
+// ReverseDeps maps each module to the sorted list of locked modules requiring it
+func (l *Lock) ReverseDeps() map[string][]string {
+	rdeps := make(map[string][]string)
+	for goPackagePath, locked := range l.Locked {
+		for _, req := range locked.Require {
+			rdeps[req] = append(rdeps[req], goPackagePath)
+		}
+	}
+	for _, dependents := range rdeps {
+		slices.Sort(dependents)
+	}
+	return rdeps
+}
+
+// TopologicalOrder returns all locked modules ordered so that requirements come before the modules requiring them.
+//
+// Members of a cycle can't be ordered relative to each other, they're returned adjacent in sorted order.
+// The order is deterministic.
+func (l *Lock) TopologicalOrder() []string {
+	// Tarjan's algorithm emits strongly connected components in reverse topological order of the condensed graph,
+	// which with edges pointing at requirements means requirements first.
+	// Visit roots in sorted order so the result is stable.
+	var order []string
+	for _, scc := range findStronglyConnectedComponents(l.Locked) {
+		sort.Strings(scc)
+		for _, goPackagePath := range scc {
+			// Requirements not in the lock are visited but aren't part of the order
+			if _, ok := l.Locked[goPackagePath]; ok {
+				order = append(order, goPackagePath)
+			}
+		}
+	}
+	return order
+}
+
+func findStronglyConnectedComponents(pkgs map[string]*Module) [][]string {
+	index := 0
+	stack := []string{}
+	indices := make(map[string]int)
+	lowlinks := make(map[string]int)
+	onStack := make(map[string]bool)
+	var sccs [][]string
+
+	var strongConnect func(string)
+	strongConnect = func(v string) {
+		indices[v] = index
+		lowlinks[v] = index
+		index++
+		stack = append(stack, v)
+		onStack[v] = true
+
+		pkg, exists := pkgs[v]
+		if exists {
+			for _, w := range pkg.Require {
+				if _, visited := indices[w]; !visited {
+					strongConnect(w)
+					if lowlinks[w] < lowlinks[v] {
+						lowlinks[v] = lowlinks[w]
+					}
+				} else if onStack[w] {
+					if indices[w] < lowlinks[v] {
+						lowlinks[v] = indices[w]
+					}
+				}
+			}
+		}
+
+		if lowlinks[v] == indices[v] {
+			var scc []string
+			for {
+				w := stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+				onStack[w] = false
+				scc = append(scc, w)
+				if w == v {
+					break
+				}
+			}
+			sccs = append(sccs, scc)
+		}
+	}
+
+	names := make([]string, 0, len(pkgs))
+	for name := range pkgs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if _, visited := indices[name]; !visited {
+			strongConnect(name)
+		}
+	}
+
+	return sccs
+}
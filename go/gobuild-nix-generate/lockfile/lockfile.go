@@ -0,0 +1,179 @@
+// Package lockfile implements reading, writing & validating gobuild-nix.lock files.
+package lockfile
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/BurntSushi/toml"
+)
+
+// The lock schema version understood by this package & mkGoSet
+const SchemaVersion = 1
+
+// Default lock file name
+const FileName = "gobuild-nix.lock"
+
+// Module usage classifications.
+// Modules without a usage are build dependencies.
+const (
+	UsageBuild = ""
+	UsageTest  = "test"
+	UsageTool  = "tool"
+)
+
+// Module is the lock entry of a single Go module
+type Module struct {
+	Version string   `toml:"version"`
+	Hash    string   `toml:"hash"`
+	Require []string `toml:"require,omitempty"`
+	// How the main module uses this module, one of the Usage constants
+	Usage string `toml:"usage,omitempty"`
+}
+
+// Lock maps goPackagePath -> lock entry
+type Lock struct {
+	Schema int `toml:"schema"`
+
+	// Go version used by the fetcher when computing hashes
+	Go string `toml:"go,omitempty"`
+	// SHA-256 of the fetcher expression used when computing hashes
+	Fetcher string `toml:"fetcher,omitempty"`
+	// Version of the generator that created the lock
+	Generator string `toml:"generator,omitempty"`
+
+	Cycles map[string]int `toml:"cycles,omitempty"`
+	// Tool package paths from go.mod tool directives -> the locked module providing them
+	Tools  map[string]string  `toml:"tools,omitempty"`
+	Locked map[string]*Module `toml:"locked"`
+}
+
+// New returns an empty lock with the current schema version
+func New() *Lock {
+	return &Lock{
+		Schema: SchemaVersion,
+		Cycles: make(map[string]int),
+		Tools:  make(map[string]string),
+		Locked: make(map[string]*Module),
+	}
+}
+
+// Parse decodes & validates a lock
+func Parse(contents []byte) (*Lock, error) {
+	lock, err := Decode(contents)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := lock.Validate(); err != nil {
+		return nil, err
+	}
+
+	return lock, nil
+}
+
+// Decode decodes a lock without validating it, so Check can report all of its problems
+func Decode(contents []byte) (*Lock, error) {
+	lock := &Lock{}
+	if err := toml.Unmarshal(contents, lock); err != nil {
+		return nil, err
+	}
+
+	if lock.Cycles == nil {
+		lock.Cycles = make(map[string]int)
+	}
+	if lock.Tools == nil {
+		lock.Tools = make(map[string]string)
+	}
+
+	return lock, nil
+}
+
+// Load reads, decodes & validates a lock from path
+func Load(path string) (*Lock, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", path, err)
+	}
+
+	lock, err := Parse(contents)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", path, err)
+	}
+
+	return lock, nil
+}
+
+// Validate checks that a lock is usable with the current schema
+func (l *Lock) Validate() error {
+	if l.Schema != SchemaVersion {
+		return fmt.Errorf("unsupported lock schema version %d, expected %d", l.Schema, SchemaVersion)
+	}
+
+	if l.Locked == nil {
+		return fmt.Errorf("lock has no locked table")
+	}
+
+	for goPackagePath, locked := range l.Locked {
+		if locked == nil {
+			return fmt.Errorf("lock entry for %s is empty", goPackagePath)
+		}
+	}
+
+	return nil
+}
+
+// Normalize sorts & deduplicates require lists
+func (l *Lock) Normalize() {
+	for _, locked := range l.Locked {
+		slices.Sort(locked.Require)
+		locked.Require = slices.Compact(locked.Require)
+	}
+}
+
+// Marshal encodes a lock deterministically.
+//
+// Tables are sorted by key & the lock is normalized,
+// so the same lock always serialises to the same bytes.
+func (l *Lock) Marshal() ([]byte, error) {
+	l.Normalize()
+
+	var buf bytes.Buffer
+	enc := toml.NewEncoder(&buf)
+	if err := enc.Encode(l); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Save atomically writes a lock to path
+func (l *Lock) Save(path string) error {
+	contents, err := l.Marshal()
+	if err != nil {
+		return err
+	}
+
+	tf, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tf.Name())
+
+	if _, err := tf.Write(contents); err != nil {
+		tf.Close()
+		return err
+	}
+	if err := tf.Chmod(0644); err != nil {
+		tf.Close()
+		return err
+	}
+	if err := tf.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tf.Name(), path)
+}
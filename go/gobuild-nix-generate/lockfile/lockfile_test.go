@@ -0,0 +1,307 @@
+package lockfile
+
+import (
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+const testHash = "sha256-dEjRvA/ak+JgGyfQ3jzMc/uiznogPtqv2j+C6xJASqU="
+
+// Build a lock from a module -> requirements map with valid versions & hashes
+func testLock(graph map[string][]string) *Lock {
+	lock := New()
+	for goPackagePath, require := range graph {
+		lock.Locked[goPackagePath] = &Module{
+			Version: "v1.0.0",
+			Hash:    testHash,
+			Require: require,
+		}
+	}
+	lock.SetCycles()
+	return lock
+}
+
+func TestFindCycles(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		graph map[string][]string
+		want  [][]string
+	}{
+		{
+			name: "acyclic",
+			graph: map[string][]string{
+				"example.com/a": {"example.com/b"},
+				"example.com/b": {"example.com/c"},
+				"example.com/c": nil,
+			},
+		},
+		{
+			name: "two module cycle",
+			graph: map[string][]string{
+				"example.com/a": {"example.com/b"},
+				"example.com/b": {"example.com/a"},
+				"example.com/c": {"example.com/a"},
+			},
+			want: [][]string{{"example.com/a", "example.com/b"}},
+		},
+		{
+			name: "separate cycles sorted",
+			graph: map[string][]string{
+				"example.com/z": {"example.com/y"},
+				"example.com/y": {"example.com/z"},
+				"example.com/c": {"example.com/b"},
+				"example.com/b": {"example.com/a"},
+				"example.com/a": {"example.com/c"},
+			},
+			want: [][]string{
+				{"example.com/a", "example.com/b", "example.com/c"},
+				{"example.com/y", "example.com/z"},
+			},
+		},
+		{
+			name: "self requirement isn't a cycle",
+			graph: map[string][]string{
+				"example.com/a": {"example.com/a"},
+			},
+		},
+		{
+			name: "unlocked requirement",
+			graph: map[string][]string{
+				"example.com/a": {"example.com/missing"},
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got := testLock(tt.graph).FindCycles()
+			if !slices.EqualFunc(got, tt.want, slices.Equal) {
+				t.Errorf("FindCycles() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTopologicalOrder(t *testing.T) {
+	lock := testLock(map[string][]string{
+		"example.com/app": {"example.com/b", "example.com/a"},
+		"example.com/a":   {"example.com/c"},
+		"example.com/b":   {"example.com/c", "example.com/missing"},
+		"example.com/c":   nil,
+	})
+
+	order := lock.TopologicalOrder()
+	if len(order) != len(lock.Locked) {
+		t.Fatalf("TopologicalOrder() = %v, want all %d locked modules", order, len(lock.Locked))
+	}
+
+	position := make(map[string]int)
+	for i, goPackagePath := range order {
+		position[goPackagePath] = i
+	}
+	for goPackagePath, locked := range lock.Locked {
+		for _, req := range locked.Require {
+			if pos, ok := position[req]; ok && pos > position[goPackagePath] {
+				t.Errorf("%s ordered before its requirement %s in %v", goPackagePath, req, order)
+			}
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		modify func(l *Lock)
+		// Substrings of the expected problems, in order
+		want []string
+	}{
+		{
+			name:   "valid",
+			modify: func(l *Lock) {},
+		},
+		{
+			name:   "schema",
+			modify: func(l *Lock) { l.Schema = 2 },
+			want:   []string{"unsupported schema version 2"},
+		},
+		{
+			name:   "fetcher",
+			modify: func(l *Lock) { l.Fetcher = "abc" },
+			want:   []string{"fetcher hash 'abc'"},
+		},
+		{
+			name:   "invalid version",
+			modify: func(l *Lock) { l.Locked["example.com/a"].Version = "1.0" },
+			want:   []string{"example.com/a: invalid version '1.0'"},
+		},
+		{
+			name:   "major version mismatch",
+			modify: func(l *Lock) { l.Locked["example.com/a"].Version = "v2.0.0" },
+			want:   []string{"example.com/a: version doesn't match module path"},
+		},
+		{
+			name:   "empty hash",
+			modify: func(l *Lock) { l.Locked["example.com/a"].Hash = "" },
+			want:   []string{"example.com/a: hash is empty"},
+		},
+		{
+			name:   "hash digest size",
+			modify: func(l *Lock) { l.Locked["example.com/a"].Hash = "sha512-" + strings.TrimPrefix(testHash, "sha256-") },
+			want:   []string{"example.com/a: hash 'sha512-"},
+		},
+		{
+			name:   "invalid usage",
+			modify: func(l *Lock) { l.Locked["example.com/a"].Usage = "bench" },
+			want:   []string{"example.com/a: invalid usage 'bench'"},
+		},
+		{
+			name: "requirements",
+			modify: func(l *Lock) {
+				l.Locked["example.com/c"].Require = []string{"example.com/c", "example.com/missing", "example.com/missing"}
+			},
+			want: []string{
+				"example.com/c: requires itself",
+				"example.com/c: requires 'example.com/missing' which is not locked",
+				"example.com/c: duplicate requirement 'example.com/missing'",
+			},
+		},
+		{
+			name:   "tool provider",
+			modify: func(l *Lock) { l.Tools["example.com/other/cmd"] = "example.com/c" },
+			want:   []string{"example.com/c: provides tool 'example.com/other/cmd' which is not in the module"},
+		},
+		{
+			name:   "missing cycle group",
+			modify: func(l *Lock) { delete(l.Cycles, "example.com/b") },
+			want: []string{
+				"example.com/a: is the only member of cycle group 0",
+				"example.com/b: is part of dependency cycle",
+			},
+		},
+		{
+			name:   "cycle group isn't a cycle",
+			modify: func(l *Lock) { l.Cycles["example.com/c"] = 1; l.Cycles["example.com/d"] = 1 },
+			want:   []string{"cycle group 1 (example.com/c, example.com/d) is not a dependency cycle"},
+		},
+		{
+			name:   "unlocked cycle member",
+			modify: func(l *Lock) { l.Cycles["example.com/missing"] = 0 },
+			want: []string{
+				"example.com/missing: is in cycle group 0 but not locked",
+				"cycle group 0 (example.com/a, example.com/b, example.com/missing) doesn't match dependency cycle (example.com/a, example.com/b)",
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			lock := testLock(map[string][]string{
+				"example.com/a": {"example.com/b"},
+				"example.com/b": {"example.com/a", "example.com/c"},
+				"example.com/c": nil,
+				"example.com/d": {"example.com/c"},
+			})
+			lock.Tools["example.com/c/cmd/tool"] = "example.com/c"
+			tt.modify(lock)
+
+			problems := lock.Check()
+			if len(problems) != len(tt.want) {
+				t.Fatalf("Check() = %v, want %d problems", problems, len(tt.want))
+			}
+			for i, problem := range problems {
+				if !strings.Contains(problem.Error(), tt.want[i]) {
+					t.Errorf("problem %d = %q, want it to contain %q", i, problem.Error(), tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	lock := testLock(map[string][]string{
+		"example.com/a": {"example.com/b", "example.com/b"},
+		"example.com/b": {"example.com/a"},
+	})
+	lock.Go = "1.24.2"
+
+	path := filepath.Join(t.TempDir(), FileName)
+	if err := lock.Save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if problems := loaded.Check(); len(problems) != 0 {
+		t.Errorf("Check() after round trip = %v", problems)
+	}
+	if got := loaded.Locked["example.com/a"].Require; !slices.Equal(got, []string{"example.com/b"}) {
+		t.Errorf("requirements weren't normalized: %v", got)
+	}
+	if loaded.Go != lock.Go || loaded.Cycles["example.com/b"] != 0 {
+		t.Errorf("round trip lost lock fields: %+v", loaded)
+	}
+
+	// Encoding is deterministic
+	a, _ := lock.Marshal()
+	b, _ := loaded.Marshal()
+	if string(a) != string(b) {
+		t.Errorf("Marshal() not stable:\n%s\n---\n%s", a, b)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		contents string
+		want     string
+	}{
+		{"schema", "schema = 2\n[locked]\n", "unsupported lock schema version 2"},
+		{"no locked table", "schema = 1\n", "lock has no locked table"},
+		{"toml", "schema = \n", "expected value"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse([]byte(tt.contents))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Parse() error = %v, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+}
+
+// Locks failing Validate are still decoded, so Check reports each of their problems
+func TestDecodeCheck(t *testing.T) {
+	contents := `schema = 2
+
+[locked]
+  [locked."example.com/a"]
+    version = "v1.0.0"
+    hash = ""
+  [locked."example.com/b"]
+    version = "v1.0.0"
+    hash = "` + testHash + `"
+`
+	if _, err := Parse([]byte(contents)); err == nil {
+		t.Fatal("Parse() of lock with unsupported schema succeeded")
+	}
+
+	lock, err := Decode([]byte(contents))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, problem := range lock.Check() {
+		got = append(got, problem.Error())
+	}
+	want := []string{
+		"unsupported schema version 2, expected 1",
+		"example.com/a: hash is empty",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("Check() = %q, want %q", got, want)
+	}
+
+	if lock, err := Decode([]byte("schema = 1\n")); err != nil || len(lock.Check()) != 1 || lock.Check()[0].Message != "lock has no locked table" {
+		t.Errorf("Check() of lock without locked table didn't report it: %v", err)
+	}
+}
@@ -2,44 +2,27 @@ package main
 
 import (
 	"bufio"
-	"bytes"
 	"flag"
 	"fmt"
+	"io/fs"
 	"log"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"regexp"
 	"slices"
 	"strings"
 	"sync"
 
-	"github.com/BurntSushi/toml"
 	"golang.org/x/mod/modfile"
 	"golang.org/x/mod/semver"
 	"golang.org/x/sync/errgroup"
 
+	"github.com/adisbladis/gobuild.nix/go/gobuild-nix-generate/lockfile"
+
 	_ "embed"
 )
 
-const SCHEMA_VERSION = 1
-const LOCK_FILE = "gobuild-nix.lock"
-
 var SumFiles = []string{"go.sum", "go.work.sum"}
 
-type goPackageLock struct {
-	Version string   `toml:"version"`
-	Hash    string   `toml:"hash"`
-	Require []string `toml:"require,omitempty"`
-}
-
-// Map goPackagePath -> lock entry
-type lockFile struct {
-	Schema int                       `toml:"schema"`
-	Cycles map[string]int            `toml:"cycles,omitempty"`
-	Locked map[string]*goPackageLock `toml:"locked"`
-}
-
 //go:embed fetcher.nix
 var fetcherExpr string
 
@@ -53,105 +36,166 @@ func filter[T any](slice []T, predicate func(T) bool) []T {
 	return result
 }
 
-func createLock(directory string, workers int, pkgsFlag string, attrFlag string) (*lockFile, error) {
-	var lockMux sync.Mutex
-	lock := &lockFile{
-		Schema: SCHEMA_VERSION,
-		Locked: make(map[string]*goPackageLock),
-		Cycles: make(map[string]int),
+// Get the highest version of each module listed in go.sum
+func readSumVersions(directory string) (map[string]string, error) {
+	sumVersions := map[string]string{}
+	var sumFile *os.File
+	var sumPath string
+	sumVersionsTemp := map[string][]string{}
+
+	found := false
+	for _, sumFileName := range SumFiles {
+		sumPath = filepath.Join(directory, sumFileName)
+		_, err := os.Stat(sumPath)
+		if err == nil {
+			found = true
+			sumFile, err = os.Open(sumPath)
+			if err != nil {
+				return nil, fmt.Errorf("error opening %s: %w", sumPath, err)
+			}
+			defer sumFile.Close()
+			break
+		}
+	}
+
+	if !found {
+		return nil, fmt.Errorf("neither go.sum nor go.work.sum was found in '%s'", directory)
 	}
 
-	// If we have a previous lock file re-use hashes instead of re-computing them if the package/version is the same
+	scanner := bufio.NewScanner(sumFile)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("error while reading %s: wrong number of fields %d", sumPath, len(fields))
+		}
+
+		packagePath := fields[0]
+		version := fields[1]
+
+		// Some indirect dependencies only specify their mod files in go.sum, but we need to download it anyway
+		// Slice of the /go.mod suffix & add it to the list for comparison
+		idx := strings.Index(version, "/")
+		if idx > -1 {
+			version = version[:idx]
+		}
+
+		sumVersionsTemp[packagePath] = append(sumVersionsTemp[packagePath], version)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error while scanning '%s': %w", sumPath, err)
+	}
+
+	for packagePath, versions := range sumVersionsTemp {
+		slices.SortFunc(versions, func(a, b string) int {
+			return semver.Compare(a, b)
+		})
+		sumVersions[packagePath] = versions[len(versions)-1]
+	}
+
+	return sumVersions, nil
+}
+
+// Read hashes from a previous lock file keyed by goPackagePath@version.
+// Hashes computed with a different Go version or fetcher are discarded.
+func readPrevHashes(path string, id *lockIdentity) (map[string]string, error) {
 	prevHashes := make(map[string]string)
-	if _, err := os.Stat(filepath.Join(directory, LOCK_FILE)); err == nil {
-		contents, err := os.ReadFile(filepath.Join(directory, LOCK_FILE))
+	if _, err := os.Stat(path); err == nil {
+		contents, err := os.ReadFile(path)
 		if err != nil {
 			return nil, fmt.Errorf("error reading previous lockfile: %w", err)
 		}
 
-		prevLock := &lockFile{}
-		err = toml.Unmarshal(contents, prevLock)
-		if err == nil { // If we're erroring out it's probably a schema change, just consider it a cache miss
+		prevLock, err := lockfile.Parse(contents)
+		if err == nil && !id.matches(prevLock.Go, prevLock.Fetcher) {
+			log.Printf("Previous lock %s was generated with a different Go version or fetcher, rehashing all modules", path)
+		} else if err == nil { // If we're erroring out it's probably a schema change, just consider it a cache miss
 			for goPackagePath, locked := range prevLock.Locked {
 				prevHashes[fmt.Sprintf("%s@%s", goPackagePath, locked.Version)] = locked.Hash
 			}
 		}
 	}
 
-	// Get all packages by reading go.sum
-	sumVersions := map[string]string{}
-	{
-		var sumFile *os.File
-		var sumPath string
-		sumVersionsTemp := map[string][]string{}
-
-		found := false
-		for _, sumFileName := range SumFiles {
-			sumPath = filepath.Join(directory, sumFileName)
-			_, err := os.Stat(sumPath)
-			if err == nil {
-				found = true
-				sumFile, err = os.Open(sumPath)
-				if err != nil {
-					return nil, fmt.Errorf("error opening %s: %w", sumPath, err)
-				}
-				defer sumFile.Close()
-				break
-			}
-		}
+	return prevHashes, nil
+}
 
-		if !found {
-			return nil, fmt.Errorf("neither go.sum nor go.work.sum was found in '%s'", directory)
-		}
+// Discover all modules in the build list of the module in directory
+func discoverModules(directory string) ([]*goModDownload, error) {
+	// Ensure we're operating on a module that has been resolved
+	if _, err := readSumVersions(directory); err != nil {
+		return nil, err
+	}
 
-		scanner := bufio.NewScanner(sumFile)
-		for scanner.Scan() {
-			line := scanner.Text()
-			if line == "" {
-				continue
-			}
+	log.Printf("Discovering dependencies of %s", directory)
+	modDownloads, err := downloadModules(directory, []string{})
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Done discovering dependencies of %s", directory)
 
-			fields := strings.Fields(line)
-			if len(fields) != 3 {
-				return nil, fmt.Errorf("error while reading %s: wrong number of fields %d", sumPath, len(fields))
-			}
+	return modDownloads, nil
+}
 
-			packagePath := fields[0]
-			version := fields[1]
+// Create a lock for the module in directory from it's discovered module downloads
+func createLock(directory string, modDownloads []*goModDownload, pool *hashPool) (*lockfile.Lock, error) {
+	lock, err := lockModules(modDownloads, pool)
+	if err != nil {
+		return nil, err
+	}
 
-			// Some indirect dependencies only specify their mod files in go.sum, but we need to download it anyway
-			// Slice of the /go.mod suffix & add it to the list for comparison
-			idx := strings.Index(version, "/")
-			if idx > -1 {
-				version = version[:idx]
-			}
+	if err := lockTools(directory, lock); err != nil {
+		return nil, err
+	}
 
-			sumVersionsTemp[packagePath] = append(sumVersionsTemp[packagePath], version)
-		}
+	return lock, classifyModules(directory, lock)
+}
 
-		if err := scanner.Err(); err != nil {
-			return nil, fmt.Errorf("error while scanning '%s': %w", sumPath, err)
+// Record the tool directives of the main module & the locked modules providing them
+func lockTools(directory string, lock *lockfile.Lock) error {
+	modPath := filepath.Join(directory, "go.mod")
+	contents, err := os.ReadFile(modPath)
+	if err != nil {
+		return fmt.Errorf("error reading %s: %w", modPath, err)
+	}
+
+	mod, err := modfile.Parse(modPath, contents, nil)
+	if err != nil {
+		return fmt.Errorf("error parsing %s: %w", modPath, err)
+	}
+
+	for _, tool := range mod.Tool {
+		// The providing module is the locked module with the longest matching prefix
+		var provider string
+		for goPackagePath := range lock.Locked {
+			if (tool.Path == goPackagePath || strings.HasPrefix(tool.Path, goPackagePath+"/")) && len(goPackagePath) > len(provider) {
+				provider = goPackagePath
+			}
 		}
 
-		for packagePath, versions := range sumVersionsTemp {
-			slices.SortFunc(versions, func(a, b string) int {
-				return semver.Compare(a, b)
-			})
-			sumVersions[packagePath] = versions[len(versions)-1]
+		if provider == "" {
+			// Tools can also be provided by the main module itself
+			log.Printf("Tool %s is not provided by any locked module, skipping", tool.Path)
+			continue
 		}
-	}
 
-	log.Println("Discovering dependencies")
-	modDownloads, err := downloadModules(directory, []string{})
-	if err != nil {
-		return nil, err
+		lock.Tools[tool.Path] = provider
 	}
-	log.Println("Done discovering dependencies")
 
-	expr := fmt.Sprintf("(with import %s { }; callPackage (%s) { go = pkgs.\"%s\"; }).fetchModuleProxy", pkgsFlag, fetcherExpr, attrFlag)
+	return nil
+}
+
+// Create a lock from module downloads
+func lockModules(modDownloads []*goModDownload, pool *hashPool) (*lockfile.Lock, error) {
+	var lockMux sync.Mutex
+	lock := lockfile.New()
 
 	eg := errgroup.Group{}
-	eg.SetLimit(workers)
+	eg.SetLimit(pool.workers)
 	for _, download := range modDownloads {
 		eg.Go(func() error {
 			var require []string
@@ -174,91 +218,13 @@ func createLock(directory string, workers int, pkgsFlag string, attrFlag string)
 				}
 			}
 
-			hash, ok := prevHashes[fmt.Sprintf("%s@%s", download.Path, download.Version)]
-			if !ok {
-				log.Printf("Fetching %s", download.Path)
-
-				cmd := exec.Command(
-					"nix-instantiate", "--expr", expr, "--argstr", "goPackagePath", download.Path, "--argstr", "version", download.Version,
-				)
-				output, err := cmd.Output()
-				if err != nil {
-					return fmt.Errorf("cmd.Output() failed with %s\n", err)
-				}
-				drvPath := strings.TrimSpace(string(output))
-
-				cmd = exec.Command(
-					"nix-store", "-r", drvPath,
-				)
-
-				stderrPipe, err := cmd.StderrPipe()
-				if err != nil {
-					return fmt.Errorf("Error getting StdoutPipe: %w", err)
-				}
-
-				err = cmd.Start()
-				if err != nil {
-					return fmt.Errorf("Error starting command: %w", err)
-				}
-
-				scanner := bufio.NewScanner(stderrPipe)
-				{
-					// Text finder state
-					const (
-						Looking       int = iota // Didn't find anything yet
-						HashMismatch             // Found hash mismatch
-						SpecifiedHash            // Found specified hash
-						ActualHash               // Found actual hash
-					)
-
-					finderState := Looking
-
-					// Find hash mismatch line
-					{
-						gotRe := regexp.MustCompile(" +got: +(.+)$")
-					Scanner:
-						for scanner.Scan() {
-							line := scanner.Bytes()
-							switch finderState {
-							case Looking:
-								if bytes.HasPrefix(line, []byte("error: hash mismatch in fixed-output")) {
-									finderState = HashMismatch
-								}
-							case HashMismatch:
-								found, err := regexp.Match(" +specified: +.+$", line)
-								if err != nil {
-									return err
-								}
-
-								if found {
-									finderState = SpecifiedHash
-								}
-							case SpecifiedHash:
-								match := gotRe.FindSubmatch(line)
-								if len(match) == 0 {
-									continue
-								}
-
-								hash = string(match[1])
-							case ActualHash:
-								break Scanner
-							}
-						}
-					}
-					if finderState != SpecifiedHash {
-						return fmt.Errorf("error prefetching %s: hash mismatch pattern not found in stream", download.Path)
-					}
-				}
-
-				if err := scanner.Err(); err != nil {
-					return fmt.Errorf("error prefetching %s: error reading from stdout: %w", download.Path, err)
-				}
-
-				cmd.Wait()
+			hash, err := pool.hash(download.Path, download.Version)
+			if err != nil {
+				return err
 			}
 
 			lockMux.Lock()
-			lock.Locked[download.Path] = &goPackageLock{
+			lock.Locked[download.Path] = &lockfile.Module{
 				Version: download.Version,
 				Hash:    hash,
 				Require: require,
@@ -269,7 +235,7 @@ func createLock(directory string, workers int, pkgsFlag string, attrFlag string)
 		})
 	}
 
-	err = eg.Wait()
+	err := eg.Wait()
 	if err != nil {
 		return nil, err
 	}
@@ -286,42 +252,246 @@ func createLock(directory string, workers int, pkgsFlag string, attrFlag string)
 		})
 	}
 
-	for i, cycle := range findAllCycles(lock.Locked) {
-		for _, depGoPackagePath := range cycle {
-			lock.Cycles[depGoPackagePath] = i
-		}
-	}
+	lock.SetCycles()
 
 	return lock, nil
 }
 
-func main() {
-	var pkgsFlag = flag.String("f", "<nixpkgs>", "path to custom nixpkgs used for prefetching")
-	var jobsFlag = flag.Int("j", 10, "number of max concurrent prefetching jobs")
-	var attrFlag = flag.String("a", "go", "go attribute to use for prefetching")
+// Directories that are never searched for modules, like Go ignores them for ./... patterns
+func isIgnoredDir(name string) bool {
+	return name == "vendor" || name == "testdata" || strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_")
+}
+
+// Find all directories containing a go.mod below root.
+// Patterns are matched against both the slash separated path relative to root & the directory name.
+func findModules(root string, ignorePatterns []string) ([]string, error) {
+	var dirs []string
+
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !d.IsDir() {
+			return nil
+		}
+
+		if path != root {
+			if isIgnoredDir(d.Name()) {
+				return filepath.SkipDir
+			}
+
+			rel, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+
+			for _, pattern := range ignorePatterns {
+				matchRel, err := filepath.Match(pattern, filepath.ToSlash(rel))
+				if err != nil {
+					return fmt.Errorf("invalid ignore pattern '%s': %w", pattern, err)
+				}
+				matchName, _ := filepath.Match(pattern, d.Name())
+				if matchRel || matchName {
+					return filepath.SkipDir
+				}
+			}
+		}
+
+		if fileExists(filepath.Join(path, "go.mod")) {
+			dirs = append(dirs, path)
+		}
 
-	flag.Parse()
+		return nil
+	})
+
+	return dirs, err
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// Result of generating a lock for a single module
+type generateResult struct {
+	directory string
+	downloads []*goModDownload
+	lock      *lockfile.Lock
+	err       error
+}
+
+func generateCmd(args []string) error {
+	flags := flag.NewFlagSet("generate", flag.ExitOnError)
+	var pkgsFlag = flags.String("f", "<nixpkgs>", "path to custom nixpkgs used for prefetching")
+	var jobsFlag = flags.Int("j", 10, "number of max concurrent prefetching jobs")
+	var attrFlag = flags.String("a", "go", "go attribute to use for prefetching")
+	var formatFlag = flags.String("format", "toml", "output format (toml, nix)")
+	var outFlag = flags.String("o", "", fmt.Sprintf("output path relative to the module (default %s for toml, %s for nix)", lockfile.FileName, NIX_SET_DIR))
+	var recursiveFlag = flags.Bool("r", false, "generate a lock for every module found below the current directory")
+	var ignorePatterns []string
+	flags.Func("ignore", "directory pattern to skip when searching for modules with -r (can be repeated)", func(pattern string) error {
+		ignorePatterns = append(ignorePatterns, pattern)
+		return nil
+	})
+
+	flags.Parse(args)
+
+	outPath := *outFlag
+	switch *formatFlag {
+	case "toml":
+		if outPath == "" {
+			outPath = lockfile.FileName
+		}
+	case "nix":
+		if outPath == "" {
+			outPath = NIX_SET_DIR
+		}
+	default:
+		return fmt.Errorf("unknown output format: %s", *formatFlag)
+	}
 
 	cwd, err := os.Getwd()
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	lock, err := createLock(cwd, *jobsFlag, *pkgsFlag, *attrFlag)
-	if err != nil {
-		panic(err)
+	directories := []string{cwd}
+	if *recursiveFlag {
+		directories, err = findModules(cwd, ignorePatterns)
+		if err != nil {
+			return err
+		}
+		if len(directories) == 0 {
+			return fmt.Errorf("no modules found below %s", cwd)
+		}
+		log.Printf("Found %d modules", len(directories))
 	}
 
-	lockContents, err := toml.Marshal(lock)
+	id, err := newLockIdentity(*pkgsFlag, *attrFlag)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	err = os.WriteFile(LOCK_FILE, lockContents, os.FileMode(0644))
-	if err != nil {
-		fmt.Printf("Error writing to file: %v\n", err)
-		return
+	// All modules share a single pool, so modules common to multiple locks are only hashed once
+	pool := newHashPool(*jobsFlag, *pkgsFlag, *attrFlag)
+	for _, directory := range directories {
+		prevHashes, err := readPrevHashes(filepath.Join(directory, lockfile.FileName), id)
+		if err != nil {
+			return err
+		}
+		pool.seed(prevHashes)
+
+		if *formatFlag == "nix" {
+			nixHashes, err := readNixSetHashes(filepath.Join(directory, outPath), id)
+			if err != nil {
+				return err
+			}
+			pool.seed(nixHashes)
+		}
+	}
+
+	results := make([]*generateResult, len(directories))
+	for i, directory := range directories {
+		results[i] = &generateResult{
+			directory: directory,
+		}
+	}
+
+	// Discover dependencies of all modules before prefetching
+	{
+		eg := errgroup.Group{}
+		eg.SetLimit(*jobsFlag)
+		for _, result := range results {
+			eg.Go(func() error {
+				result.downloads, result.err = discoverModules(result.directory)
+				return nil
+			})
+		}
+		eg.Wait()
+	}
+
+	{
+		eg := errgroup.Group{}
+		for _, result := range results {
+			if result.err != nil {
+				continue
+			}
+
+			eg.Go(func() error {
+				result.lock, result.err = createLock(result.directory, result.downloads, pool)
+				if result.err != nil {
+					return nil
+				}
+				id.apply(result.lock)
+
+				path := filepath.Join(result.directory, outPath)
+				switch *formatFlag {
+				case "toml":
+					if result.err = result.lock.Save(path); result.err == nil {
+						log.Printf("Wrote %s", path)
+					}
+				case "nix":
+					result.err = writeNixSet(result.lock, path)
+				}
+
+				return nil
+			})
+		}
+		eg.Wait()
+	}
+
+	if !*recursiveFlag {
+		return results[0].err
 	}
 
-	log.Printf("Wrote %s", LOCK_FILE)
+	// Report per-module results
+	failed := 0
+	for _, result := range results {
+		rel, err := filepath.Rel(cwd, result.directory)
+		if err != nil {
+			rel = result.directory
+		}
+
+		if result.err != nil {
+			failed++
+			log.Printf("%s: error: %v", rel, result.err)
+		} else {
+			log.Printf("%s: locked %d modules", rel, len(result.lock.Locked))
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("failed to generate %d of %d locks", failed, len(results))
+	}
+
+	return nil
+}
+
+func main() {
+	// Generating the lock is the default command when no subcommand is given
+	command := "generate"
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command = args[0]
+		args = args[1:]
+	}
+
+	var err error
+	switch command {
+	case "generate":
+		err = generateCmd(args)
+	case "import":
+		err = importCmd(args)
+	case "outdated":
+		err = outdatedCmd(args)
+	case "validate":
+		err = validateCmd(args)
+	default:
+		err = fmt.Errorf("Unknown command: %s", command)
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
 }
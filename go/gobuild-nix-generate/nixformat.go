@@ -0,0 +1,343 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"golang.org/x/mod/module"
+
+	"github.com/adisbladis/gobuild.nix/go/gobuild-nix-generate/lockfile"
+)
+
+// Default output directory for generated Nix package sets
+const NIX_SET_DIR = "gobuild-nix"
+
+const nixHeader = "# Generated by gobuild-nix-generate, do not edit.\n"
+
+// Characters allowed in a Nix path literal
+var nixPathRe = regexp.MustCompile(`^[a-zA-Z0-9._+\-]+(/[a-zA-Z0-9._+\-]+)+$`)
+
+// Matches the identity comments in a generated default.nix
+var nixIdentityRe = regexp.MustCompile(`(?m)^# (go|fetcher): (\S+)$`)
+
+// Matches fetchModuleProxy calls in generated files to recover hashes from a previous run
+var nixFetchRe = regexp.MustCompile(`goPackagePath = "([^"]+)";\s+version = "([^"]+)";\s+hash = "([^"]+)";`)
+
+func nixString(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	s = strings.ReplaceAll(s, "${", "\\${")
+	return `"` + s + `"`
+}
+
+// Format a path relative to the generated default.nix as a Nix expression
+func nixPath(rel string) string {
+	rel = filepath.ToSlash(rel)
+	if nixPathRe.MatchString(rel) {
+		return "./" + rel
+	}
+
+	dir, file, _ := strings.Cut(rel, "/")
+	return fmt.Sprintf("(./%s + %s)", dir, nixString("/"+file))
+}
+
+// Get the file path of a module relative to the set directory.
+// Module paths are escaped like in the Go proxy protocol so they're safe for case-insensitive filesystems.
+func nixModuleFile(goPackagePath string) (string, error) {
+	escaped, err := module.EscapePath(goPackagePath)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join("modules", filepath.FromSlash(escaped)+".nix"), nil
+}
+
+func nixFetch(goPackagePath string, locked *lockfile.Module, indent string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "fetchers.fetchModuleProxy {\n")
+	fmt.Fprintf(&b, "%s  goPackagePath = %s;\n", indent, nixString(goPackagePath))
+	fmt.Fprintf(&b, "%s  version = %s;\n", indent, nixString(locked.Version))
+	fmt.Fprintf(&b, "%s  hash = %s;\n", indent, nixString(locked.Hash))
+	fmt.Fprintf(&b, "%s}", indent)
+	return b.String()
+}
+
+func nixDepsList(b *strings.Builder, deps []string, indent string) {
+	if len(deps) == 0 {
+		b.WriteString("[ ]")
+		return
+	}
+
+	b.WriteString("[\n")
+	for _, dep := range deps {
+		fmt.Fprintf(b, "%s  goPackages.%s\n", indent, nixString(dep))
+	}
+	b.WriteString(indent + "]")
+}
+
+func nixDeps(b *strings.Builder, deps []string) {
+	b.WriteString("  propagatedBuildInputs = ")
+	nixDepsList(b, deps, "  ")
+	b.WriteString(";\n")
+}
+
+// Render a single module derivation.
+// This must evaluate to the same derivation as the non-cycle packages in mkGoSet.
+func nixModule(goPackagePath string, locked *lockfile.Module) string {
+	testOnly := locked.Usage == lockfile.UsageTest
+
+	var b strings.Builder
+	b.WriteString(nixHeader)
+	b.WriteString("{\n  stdenv,\n  fetchers,\n  hooks,\n  goPackages,\n")
+	if testOnly {
+		b.WriteString("  doCheck ? false,\n")
+	}
+	b.WriteString("}:\n")
+
+	if testOnly {
+		b.WriteString("stdenv.mkDerivation (\n{\n")
+	} else {
+		b.WriteString("stdenv.mkDerivation {\n")
+	}
+
+	fmt.Fprintf(&b, "  name = %s;\n", nixString(goPackagePath))
+	fmt.Fprintf(&b, "  version = %s;\n\n", nixString(locked.Version))
+	fmt.Fprintf(&b, "  src = %s;\n\n", nixFetch(goPackagePath, locked, "  "))
+	// Members of cycles are the cycle packages in the scope, like cyclePkgs in mkGoSet
+	b.WriteString("  passthru = {\n    inherit (goPackages) cycles;\n")
+	b.WriteString("    cyclePkgs = builtins.mapAttrs (goPackagePath: _: goPackages.${goPackagePath}) goPackages.cycles;\n  };\n\n")
+	b.WriteString("  nativeBuildInputs = [\n    hooks.goModuleHook\n  ];\n\n")
+
+	if testOnly {
+		// Test-only modules are only built when checks are enabled
+		b.WriteString("  propagatedBuildInputs = if doCheck then ")
+		nixDepsList(&b, locked.Require, "  ")
+		b.WriteString(" else [ ];\n")
+		b.WriteString("}\n// (if doCheck then { } else { dontBuild = true; })\n)\n")
+	} else {
+		nixDeps(&b, locked.Require)
+		b.WriteString("}\n")
+	}
+
+	return b.String()
+}
+
+// Render a derivation building all members of a cycle together.
+// This must evaluate to the same derivation as the cycle packages in mkGoSet.
+func nixCycle(idx int, members []string, lock *lockfile.Lock) string {
+	var b strings.Builder
+	b.WriteString(nixHeader)
+	b.WriteString("{\n  stdenv,\n  fetchers,\n  hooks,\n  goPackages,\n}:\n")
+	b.WriteString("stdenv.mkDerivation {\n")
+	fmt.Fprintf(&b, "  name = %s;\n\n", nixString(fmt.Sprintf("go-cycle-%d", idx)))
+
+	b.WriteString("  srcs = [\n")
+	for _, goPackagePath := range members {
+		fmt.Fprintf(&b, "    (%s)\n", nixFetch(goPackagePath, lock.Locked[goPackagePath], "    "))
+	}
+	b.WriteString("  ];\n\n")
+
+	b.WriteString("  nativeBuildInputs = [\n    hooks.goModuleHook\n  ];\n\n")
+
+	var deps []string
+	for _, goPackagePath := range members {
+		for _, req := range lock.Locked[goPackagePath].Require {
+			if !slices.Contains(members, req) {
+				deps = append(deps, req)
+			}
+		}
+	}
+	nixDeps(&b, deps)
+
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// Render the top-level scope
+func nixScope(lock *lockfile.Lock, moduleFiles map[string]string, cycleFiles map[int]string) string {
+	var b strings.Builder
+	b.WriteString(nixHeader)
+	if lock.Go != "" {
+		fmt.Fprintf(&b, "# go: %s\n", lock.Go)
+	}
+	if lock.Fetcher != "" {
+		fmt.Fprintf(&b, "# fetcher: %s\n", lock.Fetcher)
+	}
+	if lock.Generator != "" {
+		fmt.Fprintf(&b, "# generator: %s\n", lock.Generator)
+	}
+	b.WriteString("{\n  gobuild-nix,\n  go,\n  callPackage,\n  # Whether test-only dependencies should be built\n  doCheck ? false,\n}:\n")
+	b.WriteString("gobuild-nix.lib.mkGoScope {\n")
+	b.WriteString("  inherit go callPackage;\n")
+	if lock.Go != "" {
+		fmt.Fprintf(&b, "  goVersion = %s;\n", nixString(lock.Go))
+	}
+	if lock.Fetcher != "" {
+		fmt.Fprintf(&b, "  fetcherHash = %s;\n", nixString(lock.Fetcher))
+	}
+	b.WriteString("\n")
+	b.WriteString("  overlay =\n    final: prev:\n")
+
+	if len(cycleFiles) > 0 {
+		b.WriteString("    let\n")
+		for _, idx := range slices.Sorted(maps.Keys(cycleFiles)) {
+			fmt.Fprintf(&b, "      cycle-%d = final.callPackage %s { };\n", idx, nixPath(cycleFiles[idx]))
+		}
+		b.WriteString("    in\n")
+	}
+
+	b.WriteString("    {\n")
+
+	if len(lock.Cycles) == 0 {
+		b.WriteString("      cycles = { };\n\n")
+	} else {
+		b.WriteString("      cycles = {\n")
+		for _, goPackagePath := range slices.Sorted(maps.Keys(lock.Cycles)) {
+			fmt.Fprintf(&b, "        %s = %d;\n", nixString(goPackagePath), lock.Cycles[goPackagePath])
+		}
+		b.WriteString("      };\n\n")
+	}
+
+	for _, goPackagePath := range slices.Sorted(maps.Keys(lock.Locked)) {
+		if idx, ok := lock.Cycles[goPackagePath]; ok {
+			fmt.Fprintf(&b, "      %s = cycle-%d;\n", nixString(goPackagePath), idx)
+		} else if lock.Locked[goPackagePath].Usage == lockfile.UsageTest {
+			fmt.Fprintf(&b, "      %s = final.callPackage %s { inherit doCheck; };\n", nixString(goPackagePath), nixPath(moduleFiles[goPackagePath]))
+		} else {
+			fmt.Fprintf(&b, "      %s = final.callPackage %s { };\n", nixString(goPackagePath), nixPath(moduleFiles[goPackagePath]))
+		}
+	}
+
+	if len(lock.Tools) == 0 {
+		b.WriteString("\n      tools = { };\n")
+	} else {
+		b.WriteString("\n      tools = {\n")
+		for _, toolPath := range slices.Sorted(maps.Keys(lock.Tools)) {
+			fmt.Fprintf(&b, "        %s = final.mkGoTool {\n", nixString(toolPath))
+			fmt.Fprintf(&b, "          goPackagePath = %s;\n", nixString(toolPath))
+			fmt.Fprintf(&b, "          module = final.%s;\n", nixString(lock.Tools[toolPath]))
+			b.WriteString("        };\n")
+		}
+		b.WriteString("      };\n")
+	}
+
+	b.WriteString("    };\n")
+	b.WriteString("}\n")
+	return b.String()
+}
+
+func writeNixFile(path string, contents string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(contents), os.FileMode(0644))
+}
+
+// Write a lock as a static Nix package set.
+//
+// Each module or cycle group gets it's own file & default.nix ties them together in a scope.
+func writeNixSet(lock *lockfile.Lock, outDir string) error {
+	lock.Normalize()
+
+	// Remove previously generated files so removed modules don't linger
+	for _, dir := range []string{"modules", "cycles"} {
+		if err := os.RemoveAll(filepath.Join(outDir, dir)); err != nil {
+			return err
+		}
+	}
+
+	moduleFiles := make(map[string]string)
+	for goPackagePath, locked := range lock.Locked {
+		if _, ok := lock.Cycles[goPackagePath]; ok {
+			continue
+		}
+
+		file, err := nixModuleFile(goPackagePath)
+		if err != nil {
+			return err
+		}
+		moduleFiles[goPackagePath] = file
+
+		if err := writeNixFile(filepath.Join(outDir, file), nixModule(goPackagePath, locked)); err != nil {
+			return err
+		}
+	}
+
+	cycleFiles := make(map[int]string)
+	for idx, members := range lock.CycleGroups() {
+		file := filepath.Join("cycles", fmt.Sprintf("%d.nix", idx))
+		cycleFiles[idx] = file
+
+		if err := writeNixFile(filepath.Join(outDir, file), nixCycle(idx, members, lock)); err != nil {
+			return err
+		}
+	}
+
+	if err := writeNixFile(filepath.Join(outDir, "default.nix"), nixScope(lock, moduleFiles, cycleFiles)); err != nil {
+		return err
+	}
+
+	log.Printf("Wrote %s", outDir)
+
+	return nil
+}
+
+// Read hashes from a previously generated Nix package set keyed by goPackagePath@version.
+// Hashes computed with a different Go version or fetcher are discarded.
+func readNixSetHashes(outDir string, id *lockIdentity) (map[string]string, error) {
+	hashes := make(map[string]string)
+
+	scope, err := os.ReadFile(filepath.Join(outDir, "default.nix"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return hashes, nil
+		}
+		return nil, fmt.Errorf("error reading previous Nix package set: %w", err)
+	}
+
+	identity := make(map[string]string)
+	for _, match := range nixIdentityRe.FindAllStringSubmatch(string(scope), -1) {
+		identity[match[1]] = match[2]
+	}
+	if !id.matches(identity["go"], identity["fetcher"]) {
+		log.Printf("Previous Nix package set %s was generated with a different Go version or fetcher, rehashing all modules", outDir)
+		return hashes, nil
+	}
+
+	for _, dir := range []string{"modules", "cycles"} {
+		err := filepath.WalkDir(filepath.Join(outDir, dir), func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+
+			if d.IsDir() || filepath.Ext(path) != ".nix" {
+				return nil
+			}
+
+			contents, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+
+			for _, match := range nixFetchRe.FindAllStringSubmatch(string(contents), -1) {
+				hashes[fmt.Sprintf("%s@%s", match[1], match[2])] = match[3]
+			}
+
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error reading previous Nix package set: %w", err)
+		}
+	}
+
+	return hashes, nil
+}
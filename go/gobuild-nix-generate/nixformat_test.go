@@ -0,0 +1,117 @@
+package main
+
+import (
+	"flag"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/adisbladis/gobuild.nix/go/gobuild-nix-generate/lockfile"
+)
+
+var updateFlag = flag.Bool("update", false, "update golden files in testdata")
+
+const testHash = "sha256-dEjRvA/ak+JgGyfQ3jzMc/uiznogPtqv2j+C6xJASqU="
+
+// A lock covering plain, test-only, upper case & cycle modules as well as tools
+func testNixLock() *lockfile.Lock {
+	lock := lockfile.New()
+	lock.Go = "1.25.4"
+	lock.Fetcher = "708518b3f83fb9844acf7676f63b1f5ee9e856b3b5236021b599a4bab826cf0e"
+	lock.Generator = "v0.1.0"
+
+	for goPackagePath, locked := range map[string]*lockfile.Module{
+		"example.com/app-dep": {Version: "v1.2.3", Require: []string{"example.com/Upper", "example.com/cycle/a"}},
+		"example.com/Upper":   {Version: "v0.1.0"},
+		"example.com/testdep": {Version: "v1.0.0", Require: []string{"example.com/Upper"}, Usage: lockfile.UsageTest},
+		"example.com/cycle/a": {Version: "v1.0.0", Require: []string{"example.com/cycle/b"}},
+		"example.com/cycle/b": {Version: "v1.0.0", Require: []string{"example.com/cycle/a", "example.com/Upper"}},
+		"example.com/tools":   {Version: "v0.2.0", Usage: lockfile.UsageTool},
+	} {
+		locked.Hash = testHash
+		lock.Locked[goPackagePath] = locked
+	}
+	lock.SetCycles()
+	lock.Tools["example.com/tools/cmd/gen"] = "example.com/tools"
+
+	return lock
+}
+
+func TestWriteNixSet(t *testing.T) {
+	outDir := t.TempDir()
+	if err := writeNixSet(testNixLock(), outDir); err != nil {
+		t.Fatal(err)
+	}
+
+	golden := filepath.Join("testdata", "nixset")
+	if *updateFlag {
+		if err := os.RemoveAll(golden); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.CopyFS(golden, os.DirFS(outDir)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Every generated file matches its golden file & no golden file is missing
+	seen := make(map[string]bool)
+	err := filepath.WalkDir(outDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, _ := filepath.Rel(outDir, path)
+		seen[rel] = true
+
+		got, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		want, err := os.ReadFile(filepath.Join(golden, rel))
+		if err != nil {
+			t.Errorf("unexpected file %s: %v", rel, err)
+			return nil
+		}
+		if string(got) != string(want) {
+			t.Errorf("%s doesn't match golden file, rerun with -update if the change is intended:\n%s", rel, got)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = filepath.WalkDir(golden, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if rel, _ := filepath.Rel(golden, path); !seen[rel] {
+			t.Errorf("golden file %s wasn't generated", rel)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadNixSetHashes(t *testing.T) {
+	lock := testNixLock()
+	outDir := t.TempDir()
+	if err := writeNixSet(lock, outDir); err != nil {
+		t.Fatal(err)
+	}
+
+	hashes, err := readNixSetHashes(outDir, &lockIdentity{Go: lock.Go, Fetcher: lock.Fetcher})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hashes) != len(lock.Locked) || hashes["example.com/Upper@v0.1.0"] != testHash || hashes["example.com/cycle/b@v1.0.0"] != testHash {
+		t.Errorf("readNixSetHashes() = %v, want the hashes of all %d modules", hashes, len(lock.Locked))
+	}
+
+	// Hashes of a different Go version aren't reused
+	if hashes, err := readNixSetHashes(outDir, &lockIdentity{Go: "1.0", Fetcher: lock.Fetcher}); err != nil || len(hashes) != 0 {
+		t.Errorf("readNixSetHashes() with different Go = %v, %v, want no hashes", hashes, err)
+	}
+}
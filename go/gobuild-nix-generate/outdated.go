@@ -0,0 +1,394 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/adisbladis/gobuild.nix/go/gobuild-nix-generate/lockfile"
+)
+
+// errNotFound is returned by a proxy when a module or version doesn't exist.
+// Like cmd/go we fall back to the next proxy in the list on these errors.
+var errNotFound = errors.New("not found")
+
+// goProxy is a single entry in the GOPROXY list
+type goProxy struct {
+	url *url.URL
+	// Fall back to the next proxy on any error, not just on not found errors.
+	// This is the case when entries are separated by a pipe instead of a comma.
+	fallbackOnError bool
+}
+
+type proxyClient struct {
+	proxies []*goProxy
+	client  *http.Client
+}
+
+func newProxyClient(directory string) (*proxyClient, error) {
+	cmd := exec.Command("go", "env", "GOPROXY")
+	cmd.Dir = directory
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to run 'go env GOPROXY': %w", err)
+	}
+
+	return parseGoProxy(strings.TrimSpace(string(output)))
+}
+
+func parseGoProxy(value string) (*proxyClient, error) {
+	pc := &proxyClient{
+		client: &http.Client{
+			Timeout: 30 * time.Second,
+		},
+	}
+
+	for value != "" {
+		var entry string
+		fallbackOnError := false
+
+		idx := strings.IndexAny(value, ",|")
+		if idx > -1 {
+			entry = value[:idx]
+			fallbackOnError = value[idx] == '|'
+			value = value[idx+1:]
+		} else {
+			entry = value
+			value = ""
+		}
+
+		entry = strings.TrimSpace(entry)
+		switch entry {
+		case "":
+			continue
+		case "off":
+			// Any further entries are unreachable
+			value = ""
+			continue
+		case "direct":
+			// Querying version control directly is not supported
+			continue
+		}
+
+		u, err := url.Parse(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid GOPROXY entry '%s': %w", entry, err)
+		}
+
+		switch u.Scheme {
+		case "http", "https", "file":
+		default:
+			return nil, fmt.Errorf("unsupported GOPROXY scheme in '%s'", entry)
+		}
+
+		pc.proxies = append(pc.proxies, &goProxy{
+			url:             u,
+			fallbackOnError: fallbackOnError,
+		})
+	}
+
+	if len(pc.proxies) == 0 {
+		return nil, fmt.Errorf("no usable proxies in GOPROXY")
+	}
+
+	return pc, nil
+}
+
+func (p *goProxy) fetch(client *http.Client, endpoint string) ([]byte, error) {
+	if p.url.Scheme == "file" {
+		contents, err := os.ReadFile(filepath.Join(filepath.FromSlash(p.url.Path), filepath.FromSlash(endpoint)))
+		if os.IsNotExist(err) {
+			return nil, errNotFound
+		}
+		return contents, err
+	}
+
+	u := *p.url
+	u.Path = path.Join(u.Path, endpoint)
+
+	resp, err := client.Get(u.String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return io.ReadAll(resp.Body)
+	case http.StatusNotFound, http.StatusGone:
+		return nil, errNotFound
+	default:
+		return nil, fmt.Errorf("unexpected status from %s: %s", u.String(), resp.Status)
+	}
+}
+
+// Fetch a module endpoint, trying proxies in order
+func (pc *proxyClient) fetch(goPackagePath string, endpoint string) ([]byte, error) {
+	escaped, err := module.EscapePath(goPackagePath)
+	if err != nil {
+		return nil, err
+	}
+
+	err = errNotFound
+	for _, proxy := range pc.proxies {
+		var contents []byte
+		contents, err = proxy.fetch(pc.client, escaped+"/"+endpoint)
+		if err == nil {
+			return contents, nil
+		}
+
+		if !errors.Is(err, errNotFound) && !proxy.fallbackOnError {
+			break
+		}
+	}
+
+	return nil, err
+}
+
+// List all known versions of a module, including the @latest version
+func (pc *proxyClient) versions(goPackagePath string) ([]string, error) {
+	var versions []string
+
+	list, err := pc.fetch(goPackagePath, "@v/list")
+	if err != nil && !errors.Is(err, errNotFound) {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(list), "\n") {
+		line = strings.TrimSpace(line)
+		if semver.IsValid(line) {
+			versions = append(versions, line)
+		}
+	}
+
+	latest, err := pc.fetch(goPackagePath, "@latest")
+	if err == nil {
+		var info struct {
+			Version string
+		}
+		if err := json.Unmarshal(latest, &info); err != nil {
+			return nil, fmt.Errorf("error parsing @latest for %s: %w", goPackagePath, err)
+		}
+		if semver.IsValid(info.Version) && !slices.Contains(versions, info.Version) {
+			versions = append(versions, info.Version)
+		}
+	} else if !errors.Is(err, errNotFound) {
+		return nil, err
+	}
+
+	if len(versions) == 0 {
+		return nil, errNotFound
+	}
+
+	semver.Sort(versions)
+
+	return versions, nil
+}
+
+type outdatedModule struct {
+	Path    string
+	Direct  bool
+	Current string
+	Patch   string
+	Minor   string
+	Major   string
+}
+
+// Find the latest versions of a module that are newer than current.
+//
+// Prereleases are only considered if the current version is a prerelease itself.
+func latestVersions(current string, versions []string) (patch string, minor string) {
+	isPrerelease := semver.Prerelease(current) != ""
+
+	for _, version := range versions {
+		if semver.Compare(version, current) <= 0 {
+			continue
+		}
+		if !isPrerelease && semver.Prerelease(version) != "" {
+			continue
+		}
+
+		if semver.Major(version) != semver.Major(current) {
+			continue
+		}
+		minor = version
+
+		if semver.MajorMinor(version) == semver.MajorMinor(current) {
+			patch = version
+		}
+	}
+
+	return patch, minor
+}
+
+// Find the latest version of a newer major version module path.
+// Major versions >= 2 live at a different module path, so we probe successive /vN suffixes.
+func (pc *proxyClient) latestMajor(goPackagePath string) (string, error) {
+	prefix, pathMajor, ok := module.SplitPathVersion(goPackagePath)
+	if !ok || strings.HasPrefix(pathMajor, ".") {
+		// gopkg.in style paths encode the major version differently, skip them
+		return "", nil
+	}
+
+	major := 1
+	if pathMajor != "" {
+		i, err := strconv.Atoi(strings.TrimPrefix(pathMajor, "/v"))
+		if err != nil {
+			return "", fmt.Errorf("invalid major version suffix in %s", goPackagePath)
+		}
+		major = i
+	}
+
+	var latest string
+	for {
+		major++
+		versions, err := pc.versions(fmt.Sprintf("%s/v%d", prefix, major))
+		if errors.Is(err, errNotFound) {
+			break
+		} else if err != nil {
+			return "", err
+		}
+
+		var releases []string
+		for _, version := range versions {
+			if semver.Prerelease(version) == "" {
+				releases = append(releases, version)
+			}
+		}
+		if len(releases) == 0 {
+			break
+		}
+
+		latest = fmt.Sprintf("%s/v%d@%s", prefix, major, releases[len(releases)-1])
+	}
+
+	return latest, nil
+}
+
+func findOutdated(lock *lockfile.Lock, direct map[string]bool, pc *proxyClient, workers int) ([]*outdatedModule, error) {
+	var modules []*outdatedModule
+	var mux sync.Mutex
+
+	eg := errgroup.Group{}
+	eg.SetLimit(workers)
+	for goPackagePath, locked := range lock.Locked {
+		eg.Go(func() error {
+			mod := &outdatedModule{
+				Path:    goPackagePath,
+				Direct:  direct[goPackagePath],
+				Current: locked.Version,
+			}
+
+			versions, err := pc.versions(goPackagePath)
+			if err != nil && !errors.Is(err, errNotFound) {
+				return fmt.Errorf("error querying versions of %s: %w", goPackagePath, err)
+			}
+			mod.Patch, mod.Minor = latestVersions(locked.Version, versions)
+
+			mod.Major, err = pc.latestMajor(goPackagePath)
+			if err != nil {
+				return fmt.Errorf("error querying major versions of %s: %w", goPackagePath, err)
+			}
+
+			mux.Lock()
+			modules = append(modules, mod)
+			mux.Unlock()
+
+			return nil
+		})
+	}
+
+	if err := eg.Wait(); err != nil {
+		return nil, err
+	}
+
+	slices.SortFunc(modules, func(a, b *outdatedModule) int {
+		return strings.Compare(a.Path, b.Path)
+	})
+
+	return modules, nil
+}
+
+func outdatedCmd(args []string) error {
+	flags := flag.NewFlagSet("outdated", flag.ExitOnError)
+	var jobsFlag = flags.Int("j", 10, "number of max concurrent proxy queries")
+	var allFlag = flags.Bool("all", false, "also list modules that are up to date")
+
+	flags.Parse(args)
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+
+	lock, err := lockfile.Load(filepath.Join(cwd, lockfile.FileName))
+	if err != nil {
+		return err
+	}
+
+	// Direct dependencies are the non-indirect requirements of the main module
+	direct := make(map[string]bool)
+	if contents, err := os.ReadFile(filepath.Join(cwd, "go.mod")); err == nil {
+		mod, err := modfile.Parse("go.mod", contents, nil)
+		if err != nil {
+			return err
+		}
+		for _, require := range mod.Require {
+			direct[require.Mod.Path] = !require.Indirect
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	pc, err := newProxyClient(cwd)
+	if err != nil {
+		return err
+	}
+
+	modules, err := findOutdated(lock, direct, pc, *jobsFlag)
+	if err != nil {
+		return err
+	}
+
+	orDash := func(s string) string {
+		if s == "" {
+			return "-"
+		}
+		return s
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "MODULE\tDEPENDENCY\tCURRENT\tPATCH\tMINOR\tMAJOR")
+	for _, mod := range modules {
+		if !*allFlag && mod.Patch == "" && mod.Minor == "" && mod.Major == "" {
+			continue
+		}
+
+		dependency := "transitive"
+		if mod.Direct {
+			dependency = "direct"
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", mod.Path, dependency, mod.Current, orDash(mod.Patch), orDash(mod.Minor), orDash(mod.Major))
+	}
+
+	return w.Flush()
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/adisbladis/gobuild.nix/go/gobuild-nix-generate/lockfile"
+)
+
+func TestParseGoProxy(t *testing.T) {
+	type proxy struct {
+		url             string
+		fallbackOnError bool
+	}
+
+	for _, tt := range []struct {
+		value string
+		want  []proxy
+	}{
+		{"file:///srv/goproxy", []proxy{{"file:///srv/goproxy", false}}},
+		{"https://proxy.golang.org,direct", []proxy{{"https://proxy.golang.org", false}}},
+		{"https://a.example.com|file:///srv/goproxy,https://b.example.com", []proxy{
+			{"https://a.example.com", true},
+			{"file:///srv/goproxy", false},
+			{"https://b.example.com", false},
+		}},
+		{" https://a.example.com , ,off,https://b.example.com", []proxy{{"https://a.example.com", false}}},
+	} {
+		pc, err := parseGoProxy(tt.value)
+		if err != nil {
+			t.Errorf("parseGoProxy(%q) = %v", tt.value, err)
+			continue
+		}
+
+		var got []proxy
+		for _, p := range pc.proxies {
+			got = append(got, proxy{p.url.String(), p.fallbackOnError})
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseGoProxy(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+
+	for _, value := range []string{"", "off", "direct", "off,https://proxy.golang.org", "ftp://example.com"} {
+		if _, err := parseGoProxy(value); err == nil {
+			t.Errorf("parseGoProxy(%q) succeeded, want an error", value)
+		}
+	}
+}
+
+func TestLatestVersions(t *testing.T) {
+	versions := []string{"v1.0.0", "v1.0.1", "v1.1.0", "v1.2.0-rc.1", "v1.2.0-rc.2", "v2.0.0"}
+
+	for _, tt := range []struct {
+		current      string
+		patch, minor string
+	}{
+		{"v1.0.0", "v1.0.1", "v1.1.0"},
+		{"v1.0.1", "", "v1.1.0"},
+		{"v1.1.0", "", ""},
+		// Prereleases are only suggested to modules on a prerelease
+		{"v1.2.0-rc.1", "v1.2.0-rc.2", "v1.2.0-rc.2"},
+		{"v0.9.0", "", ""},
+		{"v2.0.0", "", ""},
+	} {
+		patch, minor := latestVersions(tt.current, versions)
+		if patch != tt.patch || minor != tt.minor {
+			t.Errorf("latestVersions(%q) = %q, %q, want %q, %q", tt.current, patch, minor, tt.patch, tt.minor)
+		}
+	}
+}
+
+// Write a file below a proxy directory
+func writeProxyFile(t *testing.T, dir, name, contents string) {
+	t.Helper()
+
+	path := filepath.Join(dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFindOutdatedFileProxy(t *testing.T) {
+	dir := t.TempDir()
+
+	// Module paths are case encoded like in GOMODCACHE/cache/download
+	writeProxyFile(t, dir, "example.com/!upper/@v/list", "v1.0.0\nv1.0.3\nv1.4.0\nv1.5.0-beta.1\n")
+	writeProxyFile(t, dir, "example.com/!upper/v2/@v/list", "v2.0.0\nv2.1.0\n")
+	// Major versions only known from @latest
+	writeProxyFile(t, dir, "example.com/!upper/v3/@latest", `{"Version":"v3.0.1","Time":"2025-01-01T00:00:00Z"}`)
+	// Prerelease only majors are skipped
+	writeProxyFile(t, dir, "example.com/!upper/v4/@v/list", "v4.0.0-alpha.1\n")
+	writeProxyFile(t, dir, "example.com/current/@v/list", "v0.1.0\n")
+
+	// The second proxy is used for modules missing from the first
+	fallback := t.TempDir()
+	writeProxyFile(t, fallback, "example.com/fallback/@v/list", "v1.0.0\nv1.1.0\n")
+
+	pc, err := parseGoProxy("file://" + filepath.ToSlash(dir) + ",file://" + filepath.ToSlash(fallback))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lock := lockfile.New()
+	for goPackagePath, version := range map[string]string{
+		"example.com/Upper":    "v1.0.0",
+		"example.com/current":  "v0.1.0",
+		"example.com/fallback": "v1.0.0",
+		"example.com/missing":  "v1.0.0",
+	} {
+		lock.Locked[goPackagePath] = &lockfile.Module{Version: version}
+	}
+
+	modules, err := findOutdated(lock, map[string]bool{"example.com/Upper": true}, pc, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []*outdatedModule{
+		{Path: "example.com/Upper", Direct: true, Current: "v1.0.0", Patch: "v1.0.3", Minor: "v1.4.0", Major: "example.com/Upper/v3@v3.0.1"},
+		{Path: "example.com/current", Current: "v0.1.0"},
+		{Path: "example.com/fallback", Current: "v1.0.0", Minor: "v1.1.0"},
+		{Path: "example.com/missing", Current: "v1.0.0"},
+	}
+	if !reflect.DeepEqual(modules, want) {
+		for _, mod := range modules {
+			t.Logf("got %+v", mod)
+		}
+		t.Errorf("findOutdated() doesn't match %+v", want)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// hashPool computes the fixed-output hashes of modules.
+//
+// Each module version is hashed at most once, so a pool can be shared between multiple locks.
+type hashPool struct {
+	workers int
+	expr    string
+
+	// Limits concurrent prefetches
+	sem chan struct{}
+
+	mux    sync.Mutex
+	hashes map[string]*poolHash
+}
+
+type poolHash struct {
+	done chan struct{}
+	hash string
+	err  error
+}
+
+func newHashPool(workers int, pkgsFlag string, attrFlag string) *hashPool {
+	return &hashPool{
+		workers: workers,
+		expr:    fmt.Sprintf("(with import %s { }; callPackage (%s) { go = pkgs.\"%s\"; }).fetchModuleProxy", pkgsFlag, fetcherExpr, attrFlag),
+		sem:     make(chan struct{}, workers),
+		hashes:  make(map[string]*poolHash),
+	}
+}
+
+// Add known hashes keyed by goPackagePath@version, for example from a previous lock
+func (p *hashPool) seed(hashes map[string]string) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	for key, hash := range hashes {
+		if _, ok := p.hashes[key]; ok {
+			continue
+		}
+
+		ph := &poolHash{
+			done: make(chan struct{}),
+			hash: hash,
+		}
+		close(ph.done)
+		p.hashes[key] = ph
+	}
+}
+
+// Get the hash of a module, prefetching it if it's not known yet.
+// Concurrent calls for the same module version wait for a single prefetch.
+func (p *hashPool) hash(goPackagePath string, version string) (string, error) {
+	key := fmt.Sprintf("%s@%s", goPackagePath, version)
+
+	p.mux.Lock()
+	ph, ok := p.hashes[key]
+	if !ok {
+		ph = &poolHash{
+			done: make(chan struct{}),
+		}
+		p.hashes[key] = ph
+	}
+	p.mux.Unlock()
+
+	if !ok {
+		p.sem <- struct{}{}
+		log.Printf("Fetching %s", goPackagePath)
+		ph.hash, ph.err = prefetchHash(p.expr, goPackagePath, version)
+		<-p.sem
+		close(ph.done)
+	}
+
+	<-ph.done
+	return ph.hash, ph.err
+}
+
+// Compute the hash of a module by building it's fixed-output derivation with a fake hash
+func prefetchHash(expr string, goPackagePath string, version string) (string, error) {
+	var hash string
+
+	cmd := exec.Command(
+		"nix-instantiate", "--expr", expr, "--argstr", "goPackagePath", goPackagePath, "--argstr", "version", version,
+	)
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("cmd.Output() failed with %s\n", err)
+	}
+	drvPath := strings.TrimSpace(string(output))
+
+	cmd = exec.Command(
+		"nix-store", "-r", drvPath,
+	)
+
+	stderrPipe, err := cmd.StderrPipe()
+	if err != nil {
+		return "", fmt.Errorf("Error getting StdoutPipe: %w", err)
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return "", fmt.Errorf("Error starting command: %w", err)
+	}
+
+	scanner := bufio.NewScanner(stderrPipe)
+	{
+		// Text finder state
+		const (
+			Looking       int = iota // Didn't find anything yet
+			HashMismatch             // Found hash mismatch
+			SpecifiedHash            // Found specified hash
+			ActualHash               // Found actual hash
+		)
+
+		finderState := Looking
+
+		// Find hash mismatch line
+		{
+			gotRe := regexp.MustCompile(" +got: +(.+)$")
+		Scanner:
+			for scanner.Scan() {
+				line := scanner.Bytes()
+				switch finderState {
+				case Looking:
+					if bytes.HasPrefix(line, []byte("error: hash mismatch in fixed-output")) {
+						finderState = HashMismatch
+					}
+				case HashMismatch:
+					found, err := regexp.Match(" +specified: +.+$", line)
+					if err != nil {
+						return "", err
+					}
+
+					if found {
+						finderState = SpecifiedHash
+					}
+				case SpecifiedHash:
+					match := gotRe.FindSubmatch(line)
+					if len(match) == 0 {
+						continue
+					}
+
+					hash = string(match[1])
+				case ActualHash:
+					break Scanner
+				}
+			}
+		}
+		if finderState != SpecifiedHash {
+			return "", fmt.Errorf("error prefetching %s: hash mismatch pattern not found in stream", goPackagePath)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("error prefetching %s: error reading from stdout: %w", goPackagePath, err)
+	}
+
+	cmd.Wait()
+
+	return hash, nil
+}
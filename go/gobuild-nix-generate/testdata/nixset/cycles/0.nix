@@ -0,0 +1,31 @@
+# Generated by gobuild-nix-generate, do not edit.
+{
+  stdenv,
+  fetchers,
+  hooks,
+  goPackages,
+}:
+stdenv.mkDerivation {
+  name = "go-cycle-0";
+
+  srcs = [
+    (fetchers.fetchModuleProxy {
+      goPackagePath = "example.com/cycle/a";
+      version = "v1.0.0";
+      hash = "sha256-dEjRvA/ak+JgGyfQ3jzMc/uiznogPtqv2j+C6xJASqU=";
+    })
+    (fetchers.fetchModuleProxy {
+      goPackagePath = "example.com/cycle/b";
+      version = "v1.0.0";
+      hash = "sha256-dEjRvA/ak+JgGyfQ3jzMc/uiznogPtqv2j+C6xJASqU=";
+    })
+  ];
+
+  nativeBuildInputs = [
+    hooks.goModuleHook
+  ];
+
+  propagatedBuildInputs = [
+    goPackages."example.com/Upper"
+  ];
+}
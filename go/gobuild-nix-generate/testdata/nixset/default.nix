@@ -0,0 +1,42 @@
+# Generated by gobuild-nix-generate, do not edit.
+# go: 1.25.4
+# fetcher: 708518b3f83fb9844acf7676f63b1f5ee9e856b3b5236021b599a4bab826cf0e
+# generator: v0.1.0
+{
+  gobuild-nix,
+  go,
+  callPackage,
+  # Whether test-only dependencies should be built
+  doCheck ? false,
+}:
+gobuild-nix.lib.mkGoScope {
+  inherit go callPackage;
+  goVersion = "1.25.4";
+  fetcherHash = "708518b3f83fb9844acf7676f63b1f5ee9e856b3b5236021b599a4bab826cf0e";
+
+  overlay =
+    final: prev:
+    let
+      cycle-0 = final.callPackage ./cycles/0.nix { };
+    in
+    {
+      cycles = {
+        "example.com/cycle/a" = 0;
+        "example.com/cycle/b" = 0;
+      };
+
+      "example.com/Upper" = final.callPackage (./modules + "/example.com/!upper.nix") { };
+      "example.com/app-dep" = final.callPackage ./modules/example.com/app-dep.nix { };
+      "example.com/cycle/a" = cycle-0;
+      "example.com/cycle/b" = cycle-0;
+      "example.com/testdep" = final.callPackage ./modules/example.com/testdep.nix { inherit doCheck; };
+      "example.com/tools" = final.callPackage ./modules/example.com/tools.nix { };
+
+      tools = {
+        "example.com/tools/cmd/gen" = final.mkGoTool {
+          goPackagePath = "example.com/tools/cmd/gen";
+          module = final."example.com/tools";
+        };
+      };
+    };
+}
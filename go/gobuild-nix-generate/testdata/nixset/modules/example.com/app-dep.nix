@@ -0,0 +1,31 @@
+# Generated by gobuild-nix-generate, do not edit.
+{
+  stdenv,
+  fetchers,
+  hooks,
+  goPackages,
+}:
+stdenv.mkDerivation {
+  name = "example.com/app-dep";
+  version = "v1.2.3";
+
+  src = fetchers.fetchModuleProxy {
+    goPackagePath = "example.com/app-dep";
+    version = "v1.2.3";
+    hash = "sha256-dEjRvA/ak+JgGyfQ3jzMc/uiznogPtqv2j+C6xJASqU=";
+  };
+
+  passthru = {
+    inherit (goPackages) cycles;
+    cyclePkgs = builtins.mapAttrs (goPackagePath: _: goPackages.${goPackagePath}) goPackages.cycles;
+  };
+
+  nativeBuildInputs = [
+    hooks.goModuleHook
+  ];
+
+  propagatedBuildInputs = [
+    goPackages."example.com/Upper"
+    goPackages."example.com/cycle/a"
+  ];
+}
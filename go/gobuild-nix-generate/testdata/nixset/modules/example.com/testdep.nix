@@ -0,0 +1,34 @@
+# Generated by gobuild-nix-generate, do not edit.
+{
+  stdenv,
+  fetchers,
+  hooks,
+  goPackages,
+  doCheck ? false,
+}:
+stdenv.mkDerivation (
+{
+  name = "example.com/testdep";
+  version = "v1.0.0";
+
+  src = fetchers.fetchModuleProxy {
+    goPackagePath = "example.com/testdep";
+    version = "v1.0.0";
+    hash = "sha256-dEjRvA/ak+JgGyfQ3jzMc/uiznogPtqv2j+C6xJASqU=";
+  };
+
+  passthru = {
+    inherit (goPackages) cycles;
+    cyclePkgs = builtins.mapAttrs (goPackagePath: _: goPackages.${goPackagePath}) goPackages.cycles;
+  };
+
+  nativeBuildInputs = [
+    hooks.goModuleHook
+  ];
+
+  propagatedBuildInputs = if doCheck then [
+    goPackages."example.com/Upper"
+  ] else [ ];
+}
+// (if doCheck then { } else { dontBuild = true; })
+)
@@ -0,0 +1,28 @@
+# Generated by gobuild-nix-generate, do not edit.
+{
+  stdenv,
+  fetchers,
+  hooks,
+  goPackages,
+}:
+stdenv.mkDerivation {
+  name = "example.com/tools";
+  version = "v0.2.0";
+
+  src = fetchers.fetchModuleProxy {
+    goPackagePath = "example.com/tools";
+    version = "v0.2.0";
+    hash = "sha256-dEjRvA/ak+JgGyfQ3jzMc/uiznogPtqv2j+C6xJASqU=";
+  };
+
+  passthru = {
+    inherit (goPackages) cycles;
+    cyclePkgs = builtins.mapAttrs (goPackagePath: _: goPackages.${goPackagePath}) goPackages.cycles;
+  };
+
+  nativeBuildInputs = [
+    hooks.goModuleHook
+  ];
+
+  propagatedBuildInputs = [ ];
+}
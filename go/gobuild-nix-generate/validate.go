@@ -0,0 +1,43 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/adisbladis/gobuild.nix/go/gobuild-nix-generate/lockfile"
+)
+
+func validateCmd(args []string) error {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	flags.Parse(args)
+
+	path := lockfile.FileName
+	if flags.NArg() > 0 {
+		path = flags.Arg(0)
+	}
+
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading %s: %w", path, err)
+	}
+
+	// Locks are checked without validating them first, so all problems are reported
+	lock, err := lockfile.Decode(contents)
+	if err != nil {
+		return fmt.Errorf("error parsing %s: %w", path, err)
+	}
+
+	problems := lock.Check()
+	if len(problems) == 0 {
+		log.Printf("%s is valid", path)
+		return nil
+	}
+
+	for _, problem := range problems {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", path, problem)
+	}
+
+	return fmt.Errorf("%s: found %d problems", path, len(problems))
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateCmd(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		contents string
+		want     string
+	}{
+		{
+			name:     "valid",
+			contents: "schema = 1\n[locked]\n",
+		},
+		{
+			name:     "schema & empty hash",
+			contents: "schema = 2\n[locked]\n  [locked.\"example.com/a\"]\n    version = \"v1.0.0\"\n    hash = \"\"\n",
+			want:     "found 2 problems",
+		},
+		{
+			name:     "toml",
+			contents: "schema = \n",
+			want:     "error parsing",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "gobuild-nix.lock")
+			if err := os.WriteFile(path, []byte(tt.contents), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			err := validateCmd([]string{path})
+			if tt.want == "" {
+				if err != nil {
+					t.Errorf("validateCmd() = %v", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("validateCmd() = %v, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+}
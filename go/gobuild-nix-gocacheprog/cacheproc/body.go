@@ -0,0 +1,212 @@
+package cacheproc
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"sync"
+	"time"
+)
+
+// ErrChecksum is returned when a put body doesn't match its OutputID.
+var ErrChecksum = errors.New("put body doesn't match OutputID")
+
+// stringReader reads the contents of a JSON string literal up to the closing quote.
+// Base64 never needs escaping, so escape sequences are rejected.
+type stringReader struct {
+	br  *bufio.Reader
+	eof bool
+}
+
+func (sr *stringReader) Read(p []byte) (int, error) {
+	if sr.eof {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	// Fill the buffer
+	if _, err := sr.br.Peek(1); err != nil {
+		if errors.Is(err, io.EOF) {
+			return 0, io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	buf, _ := sr.br.Peek(sr.br.Buffered())
+
+	quote := bytes.IndexByte(buf, '"')
+	if quote >= 0 {
+		buf = buf[:quote]
+	}
+
+	n := copy(p, buf)
+	if bytes.IndexByte(p[:n], '\\') >= 0 {
+		return 0, fmt.Errorf("unexpected escape sequence in put body")
+	}
+	sr.br.Discard(n)
+
+	// Consume the closing quote once everything before it was read
+	if quote == n {
+		sr.br.Discard(1)
+		sr.eof = true
+		if n == 0 {
+			return 0, io.EOF
+		}
+	}
+
+	return n, nil
+}
+
+// putBody streams the body of a put request from the protocol stream.
+//
+// The body is a base64 encoded JSON string on the line following the request.
+// It's decoded while being read & the SHA-256 of the body is verified against
+// the OutputID when reaching EOF.
+type putBody struct {
+	br       *bufio.Reader
+	dec      io.Reader
+	hash     hash.Hash
+	size     int64
+	outputID []byte
+	started  bool
+	read     int64
+
+	// Sticky result returned once the body was read to the end or failed
+	final error
+
+	// Time spent reading & decoding the body
+	readTime time.Duration
+
+	// Errors that leave the protocol stream in an unknown state
+	streamErr error
+
+	// Closed once the body was read to the end or failed, after which the stream isn't read anymore
+	done     chan struct{}
+	doneOnce sync.Once
+}
+
+func newPutBody(br *bufio.Reader, size int64, outputID []byte) *putBody {
+	return &putBody{
+		br:       br,
+		dec:      base64.NewDecoder(base64.StdEncoding, &stringReader{br: br}),
+		hash:     sha256.New(),
+		size:     size,
+		outputID: outputID,
+		done:     make(chan struct{}),
+	}
+}
+
+// Skip whitespace up to & including the opening quote of the body
+func (b *putBody) readOpeningQuote() error {
+	for {
+		c, err := b.br.ReadByte()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return io.ErrUnexpectedEOF
+			}
+			return err
+		}
+
+		switch c {
+		case '"':
+			return nil
+		case ' ', '\t', '\r', '\n':
+			continue
+		default:
+			return fmt.Errorf("expected put body string, got %q", c)
+		}
+	}
+}
+
+// Consume the rest of the line after the closing quote
+func (b *putBody) readLineEnd() error {
+	line, err := b.br.ReadBytes('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	if len(bytes.TrimSpace(line)) != 0 {
+		return fmt.Errorf("unexpected data after put body: %q", line)
+	}
+	return nil
+}
+
+func (b *putBody) Read(p []byte) (int, error) {
+	start := time.Now()
+	defer func() {
+		b.readTime += time.Since(start)
+		if b.final != nil {
+			b.finish()
+		}
+	}()
+
+	if b.final != nil {
+		return 0, b.final
+	}
+
+	if !b.started {
+		b.started = true
+		if err := b.readOpeningQuote(); err != nil {
+			return 0, b.fail(err)
+		}
+	}
+
+	n, err := b.dec.Read(p)
+	b.hash.Write(p[:n])
+	b.read += int64(n)
+
+	if err == nil {
+		if b.read > b.size {
+			return n, b.fail(fmt.Errorf("put body is larger than declared %d bytes", b.size))
+		}
+		return n, nil
+	}
+	if !errors.Is(err, io.EOF) {
+		return n, b.fail(err)
+	}
+
+	if err := b.readLineEnd(); err != nil {
+		return n, b.fail(err)
+	}
+
+	if b.read != b.size {
+		b.final = fmt.Errorf("only got %d bytes of declared %d", b.read, b.size)
+	} else if !bytes.Equal(b.hash.Sum(nil), b.outputID) {
+		b.final = ErrChecksum
+	} else {
+		b.final = io.EOF
+	}
+
+	return n, b.final
+}
+
+// Record an error leaving the protocol stream out of sync
+func (b *putBody) fail(err error) error {
+	b.streamErr = err
+	b.final = err
+	return err
+}
+
+// Signal the protocol loop that the next request can be decoded
+func (b *putBody) finish() {
+	b.doneOnce.Do(func() { close(b.done) })
+}
+
+// Read the remainder of a body the handler didn't read to the end
+func (b *putBody) drain() {
+	if b.final == nil {
+		io.Copy(io.Discard, b)
+	}
+	b.finish()
+}
+
+// Wait for the body to be read to the end & return any error that desynchronised the stream
+func (b *putBody) wait() error {
+	<-b.done
+	return b.streamErr
+}
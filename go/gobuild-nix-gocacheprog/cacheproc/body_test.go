@@ -0,0 +1,149 @@
+package cacheproc
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// Read a put body in chunks of chunkSize bytes from a stream delivering a byte at a time
+func readBody(stream string, size int64, outputID []byte, chunkSize int) (*putBody, []byte, *bufio.Reader, error) {
+	br := bufio.NewReaderSize(iotest.OneByteReader(strings.NewReader(stream)), 16)
+	body := newPutBody(br, size, outputID)
+
+	var out []byte
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := body.Read(buf)
+		out = append(out, buf[:n]...)
+		if err != nil {
+			return body, out, br, err
+		}
+	}
+}
+
+func TestPutBody(t *testing.T) {
+	data := bytes.Repeat([]byte("gobuild.nix "), 100)
+	sum := sha256.Sum256(data)
+	encoded := base64.StdEncoding.EncodeToString(data)
+
+	for _, chunkSize := range []int{1, 7, 4096} {
+		body, out, br, err := readBody(" \t\""+encoded+"\"\r\nnext\n", int64(len(data)), sum[:], chunkSize)
+		if err != io.EOF {
+			t.Fatalf("chunk size %d: Read() error = %v, want EOF", chunkSize, err)
+		}
+		if !bytes.Equal(out, data) {
+			t.Errorf("chunk size %d: decoded %q, want %q", chunkSize, out, data)
+		}
+
+		body.drain()
+		if err := body.wait(); err != nil {
+			t.Errorf("chunk size %d: wait() = %v", chunkSize, err)
+		}
+
+		// The stream is positioned at the next request
+		if rest, _ := io.ReadAll(br); string(rest) != "next\n" {
+			t.Errorf("chunk size %d: remaining stream %q, want next request", chunkSize, rest)
+		}
+	}
+}
+
+func TestPutBodyErrors(t *testing.T) {
+	data := []byte("hello world")
+	sum := sha256.Sum256(data)
+	encoded := base64.StdEncoding.EncodeToString(data)
+
+	for _, tt := range []struct {
+		name     string
+		stream   string
+		size     int64
+		outputID []byte
+		want     string
+		// Whether the stream is left out of sync
+		streamErr bool
+	}{
+		{
+			name:     "hash mismatch",
+			stream:   `"` + encoded + "\"\nnext\n",
+			size:     int64(len(data)),
+			outputID: make([]byte, sha256.Size),
+			want:     ErrChecksum.Error(),
+		},
+		{
+			name:     "short body",
+			stream:   `"` + encoded + "\"\nnext\n",
+			size:     int64(len(data)) + 1,
+			outputID: sum[:],
+			want:     "only got 11 bytes of declared 12",
+		},
+		{
+			name:      "long body",
+			stream:    `"` + base64.StdEncoding.EncodeToString(bytes.Repeat(data, 100)) + "\"\nnext\n",
+			size:      int64(len(data)),
+			outputID:  sum[:],
+			want:      "larger than declared",
+			streamErr: true,
+		},
+		{
+			name:      "data after body",
+			stream:    `"` + encoded + "\" {}\nnext\n",
+			size:      int64(len(data)),
+			outputID:  sum[:],
+			want:      "unexpected data after put body",
+			streamErr: true,
+		},
+		{
+			name:      "escape sequence",
+			stream:    `"\u0041` + encoded + "\"\nnext\n",
+			size:      int64(len(data)),
+			outputID:  sum[:],
+			want:      "unexpected escape sequence",
+			streamErr: true,
+		},
+		{
+			name:      "not a string",
+			stream:    encoded + "\nnext\n",
+			size:      int64(len(data)),
+			outputID:  sum[:],
+			want:      "expected put body string",
+			streamErr: true,
+		},
+		{
+			name:      "truncated",
+			stream:    `"` + encoded,
+			size:      int64(len(data)),
+			outputID:  sum[:],
+			want:      io.ErrUnexpectedEOF.Error(),
+			streamErr: true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			body, _, br, err := readBody(tt.stream, tt.size, tt.outputID, 5)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("Read() error = %v, want it to contain %q", err, tt.want)
+			}
+
+			// Errors are sticky
+			if _, again := body.Read(make([]byte, 1)); !errors.Is(again, err) {
+				t.Errorf("second Read() error = %v, want %v", again, err)
+			}
+
+			body.drain()
+			if streamErr := body.wait(); (streamErr != nil) != tt.streamErr {
+				t.Errorf("wait() = %v, want stream error %v", streamErr, tt.streamErr)
+			}
+
+			if !tt.streamErr {
+				if rest, _ := io.ReadAll(br); string(rest) != "next\n" {
+					t.Errorf("remaining stream %q, want next request", rest)
+				}
+			}
+		})
+	}
+}
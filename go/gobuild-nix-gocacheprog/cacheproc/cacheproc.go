@@ -17,8 +17,10 @@ import (
 	"io"
 	"log"
 	"os"
+	"runtime"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/adisbladis/gobuild.nix/go/gobuild-nix-gocacheprog/wire"
 )
@@ -51,19 +53,45 @@ type Process struct {
 	// shutting down.
 	Close func() error
 
+	// Parallelism is the maximum number of requests handled concurrently.
+	// Once reached no further requests are read until a handler finishes.
+	// If zero it defaults to 4 * GOMAXPROCS.
+	Parallelism int
+
+	// Record optionally observes every request as it's read, before it's handled.
+	// The request body is not available to it.
+	Record func(req *wire.Request)
+
 	Gets      atomic.Int64
 	GetHits   atomic.Int64
 	GetMisses atomic.Int64
 	GetErrors atomic.Int64
 	Puts      atomic.Int64
 	PutErrors atomic.Int64
+
+	GetLatency  Histogram
+	PutLatency  Histogram
+	BytesServed atomic.Int64
+	BytesStored atomic.Int64
+
+	largest       largest
+	diskNanos     atomic.Int64
+	protocolNanos atomic.Int64
+	closeNanos    atomic.Int64
 }
 
+// Run serves the protocol over stdin & stdout until stdin is closed.
 func (p *Process) Run() error {
-	br := bufio.NewReader(os.Stdin)
-	jd := json.NewDecoder(br)
+	return p.RunIO(context.Background(), os.Stdin, os.Stdout)
+}
 
-	bw := bufio.NewWriter(os.Stdout)
+// RunIO serves the protocol, reading requests from r & writing responses to w.
+// It returns once r reaches EOF and all outstanding requests were answered.
+// Get & Put are called with a context derived from ctx.
+func (p *Process) RunIO(ctx context.Context, r io.Reader, w io.Writer) error {
+	br := bufio.NewReader(r)
+
+	bw := bufio.NewWriter(w)
 	je := json.NewEncoder(bw)
 
 	var caps []wire.Cmd
@@ -82,45 +110,98 @@ func (p *Process) Run() error {
 	}
 
 	var wmu sync.Mutex // guards writing responses
+	respond := func(res *wire.Response) {
+		wmu.Lock()
+		defer wmu.Unlock()
+		start := time.Now()
+		je.Encode(res)
+		bw.Flush()
+		p.protocolNanos.Add(int64(time.Since(start)))
+	}
 
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
+	parallelism := p.Parallelism
+	if parallelism <= 0 {
+		parallelism = 4 * runtime.GOMAXPROCS(0)
+	}
+	sem := make(chan struct{}, parallelism)
+
+	// In-flight handlers, waited for before closing & returning
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
 	for {
-		var req wire.Request
-		if err := jd.Decode(&req); err != nil {
+		// Requests are one JSON object per line
+		line, err := br.ReadBytes('\n')
+		if err != nil && !(errors.Is(err, io.EOF) && len(line) > 0) {
 			if errors.Is(err, io.EOF) {
 				return nil
 			}
 			return err
 		}
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		var req wire.Request
+		if err := json.Unmarshal(line, &req); err != nil {
+			return fmt.Errorf("error decoding request: %w", err)
+		}
 		// For Go1.23 backward compatibility, remove in Go1.25.
 		if len(req.OutputID) == 0 && len(req.ObjectID) != 0 {
 			req.OutputID = req.ObjectID
 		}
-		if req.Command == wire.CmdPut && req.BodySize > 0 {
-			// TODO(bradfitz): stream this and pass a checksum-validating
-			// io.Reader that validates on EOF.
-			var bodyb []byte
-			if err := jd.Decode(&bodyb); err != nil {
-				log.Fatal(err)
-			}
-			if int64(len(bodyb)) != req.BodySize {
-				log.Fatalf("only got %d bytes of declared %d", len(bodyb), req.BodySize)
+		if p.Record != nil {
+			p.Record(&req)
+		}
+
+		// Close only once all outstanding gets & puts are done,
+		// so the backend never shuts down with writes in flight.
+		if req.Command == wire.CmdClose {
+			wg.Wait()
+
+			res := &wire.Response{ID: req.ID}
+			if err := p.handleRequest(ctx, &req, res); err != nil {
+				res.Err = err.Error()
 			}
-			req.Body = bytes.NewReader(bodyb)
+			respond(res)
+			continue
 		}
+
+		// Put bodies are streamed straight from stdin into the handler
+		var body *putBody
+		if req.Command == wire.CmdPut && req.BodySize > 0 {
+			body = newPutBody(br, req.BodySize, req.OutputID)
+			req.Body = body
+		}
+
+		// Block reading further requests while all workers are busy
+		sem <- struct{}{}
+		wg.Add(1)
 		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
 			res := &wire.Response{ID: req.ID}
 			ctx := ctx // TODO: include req ID as a context.Value for tracing?
 			if err := p.handleRequest(ctx, &req, res); err != nil {
 				res.Err = err.Error()
 			}
-			wmu.Lock()
-			defer wmu.Unlock()
-			je.Encode(res)
-			bw.Flush()
+			if body != nil {
+				body.drain()
+				p.protocolNanos.Add(int64(body.readTime))
+			}
+			respond(res)
 		}()
+
+		// The next request follows the body, wait until the handler read it to the end
+		if body != nil {
+			if err := body.wait(); err != nil {
+				return fmt.Errorf("error reading put body: %w", err)
+			}
+		}
 	}
 }
 
@@ -130,6 +211,8 @@ func (p *Process) handleRequest(ctx context.Context, req *wire.Request, res *wir
 		return errors.New("unknown command")
 	case "close":
 		if p.Close != nil {
+			start := time.Now()
+			defer func() { p.closeNanos.Add(int64(time.Since(start))) }()
 			return p.Close()
 		}
 		return nil
@@ -142,6 +225,12 @@ func (p *Process) handleRequest(ctx context.Context, req *wire.Request, res *wir
 
 func (p *Process) handleGet(ctx context.Context, req *wire.Request, res *wire.Response) (retErr error) {
 	p.Gets.Add(1)
+	start := time.Now()
+	defer func() {
+		d := time.Since(start)
+		p.GetLatency.observe(d)
+		p.diskNanos.Add(int64(d))
+	}()
 	defer func() {
 		if retErr != nil {
 			p.GetErrors.Add(1)
@@ -184,12 +273,24 @@ func (p *Process) handleGet(ctx context.Context, req *wire.Request, res *wire.Re
 	res.Size = fi.Size()
 	res.TimeNanos = fi.ModTime().UnixNano()
 	res.DiskPath = diskPath
+	p.BytesServed.Add(res.Size)
+	p.largest.observe(outputID, res.Size)
 	return nil
 }
 
 func (p *Process) handlePut(ctx context.Context, req *wire.Request, res *wire.Response) (retErr error) {
 	actionID, outputID := fmt.Sprintf("%x", req.ActionID), fmt.Sprintf("%x", req.OutputID)
 	p.Puts.Add(1)
+	start := time.Now()
+	defer func() {
+		// Reading the body is protocol time, accounted for once it's drained
+		d := time.Since(start)
+		p.PutLatency.observe(d)
+		if body, ok := req.Body.(*putBody); ok {
+			d -= body.readTime
+		}
+		p.diskNanos.Add(int64(d))
+	}()
 	defer func() {
 		if retErr != nil {
 			p.PutErrors.Add(1)
@@ -218,5 +319,7 @@ func (p *Process) handlePut(ctx context.Context, req *wire.Request, res *wire.Re
 		return fmt.Errorf("failed to write file to disk with right size: disk=%v; wanted=%v", fi.Size(), req.BodySize)
 	}
 	res.DiskPath = diskPath
+	p.BytesStored.Add(req.BodySize)
+	p.largest.observe(outputID, req.BodySize)
 	return nil
 }
@@ -0,0 +1,289 @@
+// Package client implements the cmd/go side of the GOCACHEPROG protocol.
+//
+// It can talk to any cache program, either running as a child process or
+// in-process through cacheproc.Process.RunIO.
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"slices"
+	"sync"
+
+	"github.com/adisbladis/gobuild.nix/go/gobuild-nix-gocacheprog/wire"
+)
+
+// ErrUnsupported is returned for commands the cache program didn't announce.
+var ErrUnsupported = errors.New("command not supported by cache program")
+
+// Client sends requests to a cache program & dispatches its responses.
+// It's safe for concurrent use.
+type Client struct {
+	// KnownCommands announced by the cache program during the handshake.
+	KnownCommands []wire.Cmd
+
+	wmu      sync.Mutex // guards writing requests
+	bw       *bufio.Writer
+	writeErr error // set once a request was partially written
+
+	mu      sync.Mutex
+	nextID  int64
+	pending map[int64]chan *wire.Response
+	readErr error // set once reading responses failed
+
+	closer    io.Closer
+	closeOnce sync.Once
+	closeErr  error
+	cmd       *exec.Cmd
+}
+
+// New performs the handshake with a cache program.
+// Requests are written to w & responses read from r.
+//
+// If w is an io.Closer it's closed by Close.
+func New(r io.Reader, w io.Writer) (*Client, error) {
+	c := &Client{
+		bw:      bufio.NewWriter(w),
+		pending: make(map[int64]chan *wire.Response),
+	}
+	if closer, ok := w.(io.Closer); ok {
+		c.closer = closer
+	}
+
+	jd := json.NewDecoder(bufio.NewReader(r))
+
+	var hello wire.Response
+	if err := jd.Decode(&hello); err != nil {
+		return nil, fmt.Errorf("error reading handshake: %w", err)
+	}
+	if hello.ID != 0 {
+		return nil, fmt.Errorf("unexpected handshake response ID %d", hello.ID)
+	}
+	c.KnownCommands = hello.KnownCommands
+
+	go c.readLoop(jd)
+
+	return c, nil
+}
+
+// Start starts cmd as a cache program & performs the handshake.
+// The process is waited for by Close.
+func Start(cmd *exec.Cmd) (*Client, error) {
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	c, err := New(stdout, stdin)
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, err
+	}
+	c.cmd = cmd
+
+	return c, nil
+}
+
+func (c *Client) readLoop(jd *json.Decoder) {
+	for {
+		res := new(wire.Response)
+		err := jd.Decode(res)
+		if err == nil {
+			c.mu.Lock()
+			ch, ok := c.pending[res.ID]
+			delete(c.pending, res.ID)
+			c.mu.Unlock()
+			if ok {
+				ch <- res
+				continue
+			}
+			err = fmt.Errorf("response for unknown request ID %d", res.ID)
+		}
+
+		// Fail all outstanding & future requests
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		c.mu.Lock()
+		c.readErr = err
+		for id, ch := range c.pending {
+			close(ch)
+			delete(c.pending, id)
+		}
+		c.mu.Unlock()
+		return
+	}
+}
+
+// Supports reports whether the cache program announced cmd.
+func (c *Client) Supports(cmd wire.Cmd) bool {
+	return slices.Contains(c.KnownCommands, cmd)
+}
+
+// send writes req followed by req.BodySize bytes of body & waits for the response.
+func (c *Client) send(ctx context.Context, req *wire.Request, body io.Reader) (*wire.Response, error) {
+	if !c.Supports(req.Command) {
+		return nil, fmt.Errorf("%s: %w", req.Command, ErrUnsupported)
+	}
+
+	ch := make(chan *wire.Response, 1)
+	c.mu.Lock()
+	if c.readErr != nil {
+		c.mu.Unlock()
+		return nil, c.readErr
+	}
+	c.nextID++
+	req.ID = c.nextID
+	c.pending[req.ID] = ch
+	c.mu.Unlock()
+
+	// Requests failing after this point stay pending, the buffered channel takes late responses
+	if err := c.write(req, body); err != nil {
+		return nil, err
+	}
+
+	select {
+	case res, ok := <-ch:
+		if !ok {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			return nil, c.readErr
+		}
+		if res.Err != "" {
+			return res, fmt.Errorf("%s: %s", req.Command, res.Err)
+		}
+		return res, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// write encodes a request & its base64 body onto the stream.
+//
+// A request that fails to be written completely leaves the stream out of sync,
+// so the client is broken afterwards & the stream is closed to make the cache program stop.
+func (c *Client) write(req *wire.Request, body io.Reader) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if c.writeErr != nil {
+		return c.writeErr
+	}
+
+	if err := c.encode(req, body); err != nil {
+		c.writeErr = fmt.Errorf("request stream broken: %w", err)
+		c.closeWriter()
+		return err
+	}
+
+	return nil
+}
+
+func (c *Client) encode(req *wire.Request, body io.Reader) error {
+	if err := json.NewEncoder(c.bw).Encode(req); err != nil {
+		return err
+	}
+
+	if req.BodySize > 0 {
+		c.bw.WriteByte('"')
+		enc := base64.NewEncoder(base64.StdEncoding, c.bw)
+		n, err := io.CopyN(enc, body, req.BodySize)
+		if err != nil {
+			return fmt.Errorf("error writing put body (%d of %d bytes): %w", n, req.BodySize, err)
+		}
+		if err := enc.Close(); err != nil {
+			return err
+		}
+		c.bw.WriteString("\"\n")
+	}
+
+	return c.bw.Flush()
+}
+
+// Close the request stream once
+func (c *Client) closeWriter() error {
+	c.closeOnce.Do(func() {
+		if c.closer != nil {
+			c.closeErr = c.closer.Close()
+		}
+	})
+	return c.closeErr
+}
+
+// Get looks up actionID, a lowercase hex string.
+// On a cache miss the returned response has Miss set.
+func (c *Client) Get(ctx context.Context, actionID string) (*wire.Response, error) {
+	aid, err := hex.DecodeString(actionID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid action ID: %w", err)
+	}
+
+	return c.send(ctx, &wire.Request{
+		Command:  wire.CmdGet,
+		ActionID: aid,
+	}, nil)
+}
+
+// Put stores size bytes read from body as outputID for actionID.
+// Both IDs are lowercase hex strings, outputID must be the SHA-256 of the body.
+func (c *Client) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) (diskPath string, _ error) {
+	aid, err := hex.DecodeString(actionID)
+	if err != nil {
+		return "", fmt.Errorf("invalid action ID: %w", err)
+	}
+	oid, err := hex.DecodeString(outputID)
+	if err != nil {
+		return "", fmt.Errorf("invalid output ID: %w", err)
+	}
+
+	res, err := c.send(ctx, &wire.Request{
+		Command:  wire.CmdPut,
+		ActionID: aid,
+		OutputID: oid,
+		BodySize: size,
+	}, body)
+	if err != nil {
+		return "", err
+	}
+
+	return res.DiskPath, nil
+}
+
+// Close sends a close request if supported & waits for the response.
+// Afterwards the request stream is closed & a started process is waited for.
+func (c *Client) Close(ctx context.Context) error {
+	var errs []error
+
+	if c.Supports(wire.CmdClose) {
+		if _, err := c.send(ctx, &wire.Request{Command: wire.CmdClose}, nil); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if err := c.closeWriter(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if c.cmd != nil {
+		if err := c.cmd.Wait(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
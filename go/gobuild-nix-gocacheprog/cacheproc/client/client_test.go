@@ -0,0 +1,226 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/adisbladis/gobuild.nix/go/gobuild-nix-gocacheprog/cacheproc"
+	"github.com/adisbladis/gobuild.nix/go/gobuild-nix-gocacheprog/cachers"
+)
+
+// Connect a client to p running in-process, the returned channel yields the result of RunIO
+func connect(t *testing.T, p *cacheproc.Process) (*Client, <-chan error) {
+	t.Helper()
+
+	reqR, reqW := io.Pipe()
+	resR, resW := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := p.RunIO(context.Background(), reqR, resW)
+		reqR.CloseWithError(io.ErrClosedPipe)
+		resW.Close()
+		done <- err
+	}()
+
+	c, err := New(resR, reqW)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c, done
+}
+
+func testIDs(i int) (actionID string, body []byte, outputID string) {
+	actionID = fmt.Sprintf("%064x", i)
+	body = bytes.Repeat([]byte(actionID), i%5)
+	return actionID, body, fmt.Sprintf("%x", sha256.Sum256(body))
+}
+
+func TestRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	dc := &cachers.DiskCache{Dir: t.TempDir()}
+	c, done := connect(t, &cacheproc.Process{Get: dc.Get, Put: dc.Put, Close: dc.Close})
+
+	const n = 100
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			actionID, body, outputID := testIDs(i)
+			if res, err := c.Get(ctx, actionID); err != nil || !res.Miss {
+				t.Errorf("Get(%s) before put = %+v, %v, want a miss", actionID, res, err)
+				return
+			}
+
+			diskPath, err := c.Put(ctx, actionID, outputID, int64(len(body)), bytes.NewReader(body))
+			if err != nil {
+				t.Errorf("Put(%s) = %v", actionID, err)
+				return
+			}
+
+			res, err := c.Get(ctx, actionID)
+			if err != nil || res.Miss || fmt.Sprintf("%x", res.OutputID) != outputID || res.DiskPath != diskPath || res.Size != int64(len(body)) {
+				t.Errorf("Get(%s) after put = %+v, %v, want a hit of %s", actionID, res, err, outputID)
+				return
+			}
+			if b, err := os.ReadFile(res.DiskPath); err != nil || !bytes.Equal(b, body) {
+				t.Errorf("Get(%s) returned %s which doesn't contain the body: %v", actionID, res.DiskPath, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Puts not matching their OutputID fail without breaking the stream
+	actionID, body, _ := testIDs(n + 1)
+	if _, err := c.Put(ctx, actionID, fmt.Sprintf("%064x", 0), int64(len(body)), bytes.NewReader(body)); err == nil {
+		t.Error("Put() with a wrong OutputID succeeded")
+	}
+	if res, err := c.Get(ctx, actionID); err != nil || !res.Miss {
+		t.Errorf("Get() after failed put = %+v, %v, want a miss", res, err)
+	}
+
+	if err := c.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("RunIO() = %v", err)
+	}
+}
+
+func TestCancelledRequest(t *testing.T) {
+	ctx := context.Background()
+	blocked, _, _ := testIDs(1)
+	release := make(chan struct{})
+
+	c, done := connect(t, &cacheproc.Process{
+		Get: func(ctx context.Context, actionID string) (string, string, error) {
+			if actionID == blocked {
+				<-release
+			}
+			return "", "", nil
+		},
+	})
+
+	cctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err := c.Get(cctx, blocked); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Get() of blocked action = %v, want deadline exceeded", err)
+	}
+
+	// The late response is dropped & the client keeps working
+	close(release)
+	for i := range 10 {
+		actionID, _, _ := testIDs(i + 2)
+		if res, err := c.Get(ctx, actionID); err != nil || !res.Miss {
+			t.Fatalf("Get() after cancelled request = %+v, %v, want a miss", res, err)
+		}
+	}
+
+	if err := c.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("RunIO() = %v", err)
+	}
+}
+
+func TestBrokenPut(t *testing.T) {
+	ctx := context.Background()
+	dc := &cachers.DiskCache{Dir: t.TempDir()}
+	c, done := connect(t, &cacheproc.Process{Get: dc.Get, Put: dc.Put, Close: dc.Close})
+
+	// The body ends before the declared size, after part of it was sent
+	actionID, _, _ := testIDs(3)
+	body := bytes.Repeat([]byte("x"), 64<<10)
+	outputID := fmt.Sprintf("%x", sha256.Sum256(body))
+	if _, err := c.Put(ctx, actionID, outputID, int64(len(body))+10, bytes.NewReader(body)); err == nil {
+		t.Fatal("Put() with a short body succeeded")
+	}
+
+	// The request stream is closed, so the cache program doesn't wait for the rest of the body
+	if err := <-done; err == nil || !strings.Contains(err.Error(), "put body") {
+		t.Errorf("RunIO() = %v, want a put body error", err)
+	}
+
+	// Later requests fail instead of being misread by the cache program
+	if _, err := c.Get(ctx, actionID); err == nil {
+		t.Error("Get() after broken put succeeded")
+	}
+	if _, err := c.Put(ctx, actionID, outputID, int64(len(body)), bytes.NewReader(body)); err == nil {
+		t.Error("Put() after broken put succeeded")
+	}
+}
+
+func TestSlowPut(t *testing.T) {
+	ctx := context.Background()
+	diskPath := filepath.Join(t.TempDir(), "output")
+	bodyRead := make(chan struct{})
+	release := make(chan struct{})
+
+	c, done := connect(t, &cacheproc.Process{
+		Get: func(ctx context.Context, actionID string) (string, string, error) {
+			return "", "", nil
+		},
+		Put: func(ctx context.Context, actionID, outputID string, size int64, body io.Reader) (string, error) {
+			b, err := io.ReadAll(body)
+			if err != nil {
+				return "", err
+			}
+			// Keep writing to a slow backend after the body was read
+			close(bodyRead)
+			<-release
+			return diskPath, os.WriteFile(diskPath, b, 0o644)
+		},
+	})
+
+	actionID, body, outputID := testIDs(4)
+	putErr := make(chan error, 1)
+	go func() {
+		_, err := c.Put(ctx, actionID, outputID, int64(len(body)), bytes.NewReader(body))
+		putErr <- err
+	}()
+	<-bodyRead
+
+	// Requests following a put are handled once its body was read, not once the put finished.
+	// Writing the request blocks while the stream isn't read, so the get isn't bound by a context.
+	getErr := make(chan error, 1)
+	go func() {
+		res, err := c.Get(ctx, actionID)
+		if err == nil && !res.Miss {
+			err = fmt.Errorf("got %+v, want a miss", res)
+		}
+		getErr <- err
+	}()
+	select {
+	case err := <-getErr:
+		if err != nil {
+			t.Errorf("Get() during slow put = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Get() wasn't answered while a put was still running")
+	}
+
+	close(release)
+	if err := <-putErr; err != nil {
+		t.Errorf("Put() = %v", err)
+	}
+
+	if err := c.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("RunIO() = %v", err)
+	}
+}
@@ -0,0 +1,179 @@
+package cacheproc
+
+import (
+	"cmp"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LatencyBuckets are the upper bounds of Histogram buckets.
+var LatencyBuckets = [...]time.Duration{
+	10 * time.Microsecond,
+	25 * time.Microsecond,
+	50 * time.Microsecond,
+	100 * time.Microsecond,
+	250 * time.Microsecond,
+	500 * time.Microsecond,
+	1 * time.Millisecond,
+	2500 * time.Microsecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	1 * time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// Histogram counts request latencies in LatencyBuckets.
+// It's safe for concurrent use.
+type Histogram struct {
+	// Per bucket counts, the last bucket counts observations above all bounds
+	counts [len(LatencyBuckets) + 1]atomic.Int64
+	count  atomic.Int64
+	sum    atomic.Int64 // nanoseconds
+}
+
+func (h *Histogram) observe(d time.Duration) {
+	i, _ := slices.BinarySearch(LatencyBuckets[:], d)
+	h.counts[i].Add(1)
+	h.count.Add(1)
+	h.sum.Add(int64(d))
+}
+
+// Bucket is a cumulative histogram bucket.
+type Bucket struct {
+	LE    time.Duration `json:"le"`
+	Count int64         `json:"count"`
+}
+
+// HistogramSnapshot is a point in time copy of a Histogram.
+type HistogramSnapshot struct {
+	Count int64         `json:"count"`
+	Sum   time.Duration `json:"sum"`
+
+	// Cumulative counts per upper bound, observations above all bounds are only included in Count
+	Buckets []Bucket `json:"buckets"`
+}
+
+// Snapshot copies the current state of the histogram.
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	s := HistogramSnapshot{
+		Count:   h.count.Load(),
+		Sum:     time.Duration(h.sum.Load()),
+		Buckets: make([]Bucket, len(LatencyBuckets)),
+	}
+
+	var cumulative int64
+	for i, le := range LatencyBuckets {
+		cumulative += h.counts[i].Load()
+		s.Buckets[i] = Bucket{LE: le, Count: cumulative}
+	}
+
+	return s
+}
+
+// Quantile estimates the q-th quantile as the upper bound of the bucket containing it.
+// ok is false if the quantile is above the largest bound.
+func (s HistogramSnapshot) Quantile(q float64) (le time.Duration, ok bool) {
+	if s.Count == 0 {
+		return 0, true
+	}
+
+	rank := int64(q * float64(s.Count))
+	for _, b := range s.Buckets {
+		if b.Count > rank {
+			return b.LE, true
+		}
+	}
+
+	return LatencyBuckets[len(LatencyBuckets)-1], false
+}
+
+// Mean latency of all observations.
+func (s HistogramSnapshot) Mean() time.Duration {
+	if s.Count == 0 {
+		return 0
+	}
+	return s.Sum / time.Duration(s.Count)
+}
+
+// Number of largest objects kept track of
+const largestObjects = 5
+
+// Object is a cache output served or stored.
+type Object struct {
+	OutputID string `json:"outputID"`
+	Size     int64  `json:"size"`
+}
+
+// largest keeps the largest distinct objects seen.
+type largest struct {
+	mu      sync.Mutex
+	objects []Object
+}
+
+func (l *largest) observe(outputID string, size int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.objects) == largestObjects && size <= l.objects[len(l.objects)-1].Size {
+		return
+	}
+	if slices.ContainsFunc(l.objects, func(o Object) bool { return o.OutputID == outputID }) {
+		return
+	}
+
+	l.objects = append(l.objects, Object{OutputID: outputID, Size: size})
+	slices.SortFunc(l.objects, func(a, b Object) int {
+		return cmp.Or(cmp.Compare(b.Size, a.Size), cmp.Compare(a.OutputID, b.OutputID))
+	})
+	l.objects = l.objects[:min(len(l.objects), largestObjects)]
+}
+
+// Metrics describes the performance of the cache process.
+type Metrics struct {
+	Get HistogramSnapshot `json:"get"`
+	Put HistogramSnapshot `json:"put"`
+
+	// Bytes returned by get hits & accepted by puts
+	BytesServed int64 `json:"bytesServed"`
+	BytesStored int64 `json:"bytesStored"`
+
+	// Largest objects served or stored
+	Largest []Object `json:"largest"`
+
+	// Time spent in the cache backend & stat'ing its files, excluding reading put bodies.
+	// Requests are handled concurrently, so this is the sum over all requests & can exceed the wall time.
+	DiskTime time.Duration `json:"diskTime"`
+
+	// Time spent decoding put bodies & writing responses, summed over all requests like DiskTime
+	ProtocolTime time.Duration `json:"protocolTime"`
+
+	// Time spent closing the cache backend, such as finishing uploads & trimming
+	CloseTime time.Duration `json:"closeTime"`
+}
+
+// Metrics returns a snapshot of the latency & size metrics.
+func (p *Process) Metrics() *Metrics {
+	p.largest.mu.Lock()
+	objects := append([]Object{}, p.largest.objects...)
+	p.largest.mu.Unlock()
+
+	return &Metrics{
+		Get:          p.GetLatency.Snapshot(),
+		Put:          p.PutLatency.Snapshot(),
+		BytesServed:  p.BytesServed.Load(),
+		BytesStored:  p.BytesStored.Load(),
+		Largest:      objects,
+		DiskTime:     time.Duration(p.diskNanos.Load()),
+		ProtocolTime: time.Duration(p.protocolNanos.Load()),
+		CloseTime:    time.Duration(p.closeNanos.Load()),
+	}
+}
@@ -0,0 +1,47 @@
+package cacheproc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHistogramQuantile(t *testing.T) {
+	var h Histogram
+	for range 90 {
+		h.observe(20 * time.Microsecond)
+	}
+	for range 9 {
+		h.observe(time.Second)
+	}
+	h.observe(time.Minute)
+
+	s := h.Snapshot()
+	if s.Count != 100 {
+		t.Fatalf("Count = %d, want 100", s.Count)
+	}
+	if want := 90*20*time.Microsecond + 9*time.Second + time.Minute; s.Sum != want {
+		t.Errorf("Sum = %v, want %v", s.Sum, want)
+	}
+	if last := s.Buckets[len(s.Buckets)-1]; last.Count != 99 {
+		t.Errorf("largest bucket %v counts %d, want observations above it excluded", last.LE, last.Count)
+	}
+
+	for _, tt := range []struct {
+		q    float64
+		want time.Duration
+		ok   bool
+	}{
+		{0.5, 25 * time.Microsecond, true},
+		{0.9, time.Second, true},
+		{0.98, time.Second, true},
+		{0.995, 10 * time.Second, false},
+	} {
+		if le, ok := s.Quantile(tt.q); le != tt.want || ok != tt.ok {
+			t.Errorf("Quantile(%v) = %v, %v, want %v, %v", tt.q, le, ok, tt.want, tt.ok)
+		}
+	}
+
+	if le, ok := (HistogramSnapshot{}).Quantile(0.5); le != 0 || !ok {
+		t.Errorf("Quantile() of empty histogram = %v, %v", le, ok)
+	}
+}
@@ -0,0 +1,122 @@
+package cachers
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Entry is an action entry of a cache directory.
+type Entry struct {
+	ActionID  string
+	OutputID  string
+	Size      int64
+	TimeNanos int64
+
+	// Compression of the output file, empty for uncompressed outputs
+	Compression string
+
+	// Modification time of the action file, which is bumped on hits in caches tracking access
+	ModTime time.Time
+}
+
+// CacheDir is the contents of a cache directory in the a-/o- layout written by DiskCache.
+type CacheDir struct {
+	Dir string
+
+	// Valid action entries by actionID
+	Actions map[string]*Entry
+
+	// Output sizes on disk by outputID
+	Outputs map[string]int64
+
+	// Output modification times by outputID
+	OutputModTimes map[string]time.Time
+
+	// Action entries that couldn't be read or parsed, mapped to the reason
+	Malformed map[string]string
+
+	// Action entries with an OutputID that isn't hex, mapped to the OutputID
+	InvalidOutputIDs map[string]string
+}
+
+// ReadCacheDir reads all action entries & outputs of a cache directory.
+// Temporary files of in-progress writes are ignored.
+func ReadCacheDir(dir string) (*CacheDir, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	cd := &CacheDir{
+		Dir:     dir,
+		Actions: make(map[string]*Entry),
+		Outputs: make(map[string]int64),
+
+		OutputModTimes: make(map[string]time.Time),
+		Malformed:      make(map[string]string),
+
+		InvalidOutputIDs: make(map[string]string),
+	}
+
+	for _, de := range entries {
+		name := de.Name()
+		if strings.Contains(name, ".") || de.IsDir() {
+			continue
+		}
+
+		if outputID, ok := strings.CutPrefix(name, "o-"); ok {
+			fi, err := de.Info()
+			if err != nil {
+				return nil, err
+			}
+			cd.Outputs[outputID] = fi.Size()
+			cd.OutputModTimes[outputID] = fi.ModTime()
+			continue
+		}
+
+		actionID, ok := strings.CutPrefix(name, "a-")
+		if !ok {
+			continue
+		}
+
+		fi, err := de.Info()
+		if err != nil {
+			cd.Malformed[actionID] = err.Error()
+			continue
+		}
+
+		ij, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			cd.Malformed[actionID] = err.Error()
+			continue
+		}
+
+		var ie indexEntry
+		if err := json.Unmarshal(ij, &ie); err != nil {
+			cd.Malformed[actionID] = fmt.Sprintf("invalid JSON: %v", err)
+			continue
+		}
+
+		if _, err := hex.DecodeString(ie.OutputID); err != nil || ie.OutputID == "" {
+			cd.InvalidOutputIDs[actionID] = ie.OutputID
+			continue
+		}
+
+		cd.Actions[actionID] = &Entry{
+			ActionID:  actionID,
+			OutputID:  ie.OutputID,
+			Size:      ie.Size,
+			TimeNanos: ie.TimeNanos,
+			ModTime:   fi.ModTime(),
+
+			Compression: ie.Compression,
+		}
+	}
+
+	return cd, nil
+}
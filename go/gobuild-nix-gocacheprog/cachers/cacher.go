@@ -0,0 +1,61 @@
+package cachers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+)
+
+// ErrReadOnly is returned by Put on caches that can't be written to.
+var ErrReadOnly = errors.New("cache is read-only")
+
+// Cacher is a cache backend that can be wired to a cacheproc.Process.
+//
+// Get & Put have the same semantics as the cacheproc.Process funcs of the same name.
+type Cacher interface {
+	Get(ctx context.Context, actionID string) (outputID, diskPath string, err error)
+	Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) (diskPath string, err error)
+
+	// Close is called when cmd/go is shutting down, after all gets & puts returned.
+	// It must not return before background work such as uploads is finished.
+	Close() error
+}
+
+// DirCacher is implemented by caches reporting the cache directory serving a get or storing a put.
+//
+// The directory is the cache directory containing the entry or the URL of a remote,
+// not the directory compressed outputs were decompressed to.
+type DirCacher interface {
+	Cacher
+
+	GetDir(ctx context.Context, actionID string) (outputID, diskPath, dir string, err error)
+	PutDir(ctx context.Context, actionID, outputID string, size int64, body io.Reader) (diskPath, dir string, err error)
+}
+
+// GetDir gets an entry from c along with the cache directory serving it.
+// Caches not implementing DirCacher are assumed to serve outputs from their cache directory.
+func GetDir(ctx context.Context, c Cacher, actionID string) (outputID, diskPath, dir string, err error) {
+	if dg, ok := c.(DirCacher); ok {
+		return dg.GetDir(ctx, actionID)
+	}
+
+	outputID, diskPath, err = c.Get(ctx, actionID)
+	if outputID != "" {
+		dir = filepath.Dir(diskPath)
+	}
+	return outputID, diskPath, dir, err
+}
+
+// PutDir puts an entry into c & returns the cache directory storing it, like GetDir.
+func PutDir(ctx context.Context, c Cacher, actionID, outputID string, size int64, body io.Reader) (diskPath, dir string, err error) {
+	if dc, ok := c.(DirCacher); ok {
+		return dc.PutDir(ctx, actionID, outputID, size, body)
+	}
+
+	diskPath, err = c.Put(ctx, actionID, outputID, size, body)
+	if err != nil {
+		return "", "", err
+	}
+	return diskPath, filepath.Dir(diskPath), nil
+}
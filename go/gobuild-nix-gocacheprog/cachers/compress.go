@@ -0,0 +1,142 @@
+package cachers
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression formats recorded in indexEntry
+const (
+	compressionNone = ""
+	compressionZstd = "zstd"
+)
+
+// Outputs smaller than this aren't worth compressing
+const minCompressSize = 4096
+
+// scratchDir holds uncompressed copies of compressed outputs.
+//
+// cmd/go requires outputs to be regular uncompressed files,
+// so compressed outputs are materialised in a private temporary directory.
+type scratchDir struct {
+	once sync.Once
+	dir  string
+	err  error
+}
+
+func (s *scratchDir) path(outputID string) (string, error) {
+	s.once.Do(func() {
+		s.dir, s.err = os.MkdirTemp("", "gobuild-nix-gocacheprog-")
+	})
+	if s.err != nil {
+		return "", s.err
+	}
+	return filepath.Join(s.dir, fmt.Sprintf("o-%s", outputID)), nil
+}
+
+// Decompress an output into the scratch directory, reusing earlier decompressions
+func (s *scratchDir) decompress(src string, outputID string) (string, error) {
+	dest, err := s.path(outputID)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := os.Stat(dest); err == nil {
+		return dest, nil
+	}
+
+	f, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	zr, err := zstd.NewReader(f, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return "", err
+	}
+	defer zr.Close()
+
+	if _, err := writeAtomic(dest, zr); err != nil {
+		return "", fmt.Errorf("error decompressing %s: %w", src, err)
+	}
+
+	return dest, nil
+}
+
+func (s *scratchDir) remove() error {
+	if s.dir == "" {
+		return nil
+	}
+	return os.RemoveAll(s.dir)
+}
+
+// Resolve the uncompressed path of an output
+func (s *scratchDir) resolve(ie *indexEntry, diskPath string) (string, error) {
+	switch ie.Compression {
+	case compressionNone:
+		return diskPath, nil
+	case compressionZstd:
+		return s.decompress(diskPath, ie.OutputID)
+	default:
+		return "", fmt.Errorf("unsupported compression %q", ie.Compression)
+	}
+}
+
+// Write an output compressed with zstd while keeping an uncompressed copy in the scratch directory.
+// Returns the number of uncompressed bytes & the path of the uncompressed copy.
+func (s *scratchDir) writeCompressed(dest string, outputID string, body io.Reader) (int64, string, error) {
+	plainPath, err := s.path(outputID)
+	if err != nil {
+		return 0, "", err
+	}
+
+	plain, err := os.CreateTemp(filepath.Dir(plainPath), filepath.Base(plainPath)+".*")
+	if err != nil {
+		return 0, "", err
+	}
+	defer os.Remove(plain.Name())
+	defer plain.Close()
+
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		zw, err := zstd.NewWriter(pw, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		if _, err := io.Copy(zw, io.TeeReader(body, plain)); err != nil {
+			zw.Close()
+			pw.CloseWithError(err)
+			return
+		}
+		pw.CloseWithError(zw.Close())
+	}()
+
+	if _, err := writeAtomic(dest, pr); err != nil {
+		// The body must not be read after returning
+		pr.CloseWithError(err)
+		<-done
+		return 0, "", err
+	}
+
+	fi, err := plain.Stat()
+	if err != nil {
+		return 0, "", err
+	}
+	if err := plain.Close(); err != nil {
+		return 0, "", err
+	}
+	if err := os.Rename(plain.Name(), plainPath); err != nil {
+		return 0, "", err
+	}
+
+	return fi.Size(), plainPath, nil
+}
@@ -0,0 +1,162 @@
+package cachers
+
+import (
+	"bytes"
+	"context"
+	"math/rand/v2"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Build output like data, mostly repetitive with some incompressible parts
+func testOutput(size int) []byte {
+	rng := rand.New(rand.NewChaCha8([32]byte{}))
+	text := []byte("go.shape.struct { Name string; Size int64 } runtime.gcWriteBarrier ")
+
+	var buf bytes.Buffer
+	for buf.Len() < size {
+		if rng.IntN(4) == 0 {
+			chunk := make([]byte, 64)
+			for i := range chunk {
+				chunk[i] = byte(rng.Uint32())
+			}
+			buf.Write(chunk)
+		} else {
+			buf.Write(text)
+		}
+	}
+	return buf.Bytes()[:size]
+}
+
+func TestDiskCacheCompress(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	output := testOutput(64 << 10)
+	outputID := testOutputID(output)
+
+	dc := &DiskCache{Dir: dir, Compress: true}
+	diskPath, err := dc.Put(ctx, testActionID(1), outputID, int64(len(output)), bytes.NewReader(output))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(diskPath); err != nil || !bytes.Equal(b, output) {
+		t.Fatalf("Put() returned %s which doesn't contain the output: %v", diskPath, err)
+	}
+	if err := dc.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Stat(filepath.Join(dir, "o-"+outputID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() >= int64(len(output)) {
+		t.Errorf("stored output is %d bytes, want it compressed from %d bytes", fi.Size(), len(output))
+	}
+
+	// Compressed outputs are served uncompressed by a new process
+	dc = &DiskCache{Dir: dir}
+	defer dc.Close()
+	gotID, diskPath, err := dc.Get(ctx, testActionID(1))
+	if err != nil || gotID != outputID {
+		t.Fatalf("Get() = %q, %v, want %q", gotID, err, outputID)
+	}
+	if b, err := os.ReadFile(diskPath); err != nil || !bytes.Equal(b, output) {
+		t.Errorf("Get() returned %s which doesn't contain the output: %v", diskPath, err)
+	}
+}
+
+func TestHTTPCacheCompressedRemote(t *testing.T) {
+	ctx := context.Background()
+	output := testOutput(64 << 10)
+	outputID := testOutputID(output)
+
+	// The remote serves a directory written with compression as is
+	remoteDir := t.TempDir()
+	dc := &DiskCache{Dir: remoteDir, Compress: true}
+	if _, err := dc.Put(ctx, testActionID(1), outputID, int64(len(output)), bytes.NewReader(output)); err != nil {
+		t.Fatal(err)
+	}
+	dc.Close()
+
+	srv := httptest.NewServer(&Server{Dir: remoteDir})
+	defer srv.Close()
+
+	hc := &HTTPCache{BaseURL: srv.URL, Local: &DiskCache{Dir: t.TempDir()}}
+	defer hc.Close()
+
+	gotID, diskPath, err := hc.Get(ctx, testActionID(1))
+	if err != nil || gotID != outputID {
+		t.Fatalf("Get() = %q, %v, want %q", gotID, err, outputID)
+	}
+	if b, err := os.ReadFile(diskPath); err != nil || !bytes.Equal(b, output) {
+		t.Errorf("Get() returned %s which doesn't contain the output: %v", diskPath, err)
+	}
+}
+
+// Report the size of the stored output relative to the uncompressed output
+func reportRatio(b *testing.B, dir, outputID string, size int) {
+	fi, err := os.Stat(filepath.Join(dir, "o-"+outputID))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportMetric(float64(fi.Size())/float64(size), "size-ratio")
+}
+
+func BenchmarkDiskCachePut(b *testing.B) {
+	output := testOutput(1 << 20)
+	outputID := testOutputID(output)
+
+	for _, compress := range []bool{false, true} {
+		name := "plain"
+		if compress {
+			name = "zstd"
+		}
+		b.Run(name, func(b *testing.B) {
+			dc := &DiskCache{Dir: b.TempDir(), Compress: compress}
+			defer dc.Close()
+
+			b.SetBytes(int64(len(output)))
+			for i := range b.N {
+				if _, err := dc.Put(context.Background(), testActionID(i), outputID, int64(len(output)), bytes.NewReader(output)); err != nil {
+					b.Fatal(err)
+				}
+			}
+			reportRatio(b, dc.Dir, outputID, len(output))
+		})
+	}
+}
+
+func BenchmarkDiskCacheGet(b *testing.B) {
+	output := testOutput(1 << 20)
+	outputID := testOutputID(output)
+
+	for _, compress := range []bool{false, true} {
+		name := "plain"
+		if compress {
+			name = "zstd"
+		}
+		b.Run(name, func(b *testing.B) {
+			dir := b.TempDir()
+			dc := &DiskCache{Dir: dir, Compress: compress}
+			if _, err := dc.Put(context.Background(), testActionID(1), outputID, int64(len(output)), bytes.NewReader(output)); err != nil {
+				b.Fatal(err)
+			}
+			dc.Close()
+
+			// Each process decompresses outputs once, so every get is a new process
+			b.SetBytes(int64(len(output)))
+			b.ResetTimer()
+			for range b.N {
+				dc := &DiskCache{Dir: dir}
+				if gotID, _, err := dc.Get(context.Background(), testActionID(1)); err != nil || gotID != outputID {
+					b.Fatalf("Get() = %q, %v", gotID, err)
+				}
+				dc.Close()
+			}
+			reportRatio(b, dir, outputID, len(output))
+		})
+	}
+}
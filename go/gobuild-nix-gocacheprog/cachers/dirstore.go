@@ -0,0 +1,180 @@
+package cachers
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// DirStore is a read-only cache over a list of cache directories, such as the
+// outputs of dependency derivations in NIX_GOBUILD_CACHE.
+//
+// Directories are searched in order & the first hit wins.
+//
+// Input directories are immutable store paths, so instead of probing every directory on each Get
+// the directories are listed once & actionIDs are mapped to the directory containing them.
+type DirStore struct {
+	Dirs []string
+
+	// Debug cache hits/misses
+	Verbose bool
+
+	indexOnce sync.Once
+	index     map[string]string // actionID -> dir
+
+	hitsMu sync.Mutex
+	hits   map[string]int64 // dir -> hits
+
+	// Uncompressed copies of compressed outputs
+	scratch scratchDir
+}
+
+var (
+	_ Cacher    = (*DirStore)(nil)
+	_ DirCacher = (*DirStore)(nil)
+)
+
+// List action entries of a single cache directory
+func listActions(dir string) ([]string, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+
+	actionIDs := make([]string, 0, len(names)/2)
+	for _, name := range names {
+		if actionID, ok := strings.CutPrefix(name, "a-"); ok && !strings.Contains(actionID, ".") {
+			actionIDs = append(actionIDs, actionID)
+		}
+	}
+
+	return actionIDs, nil
+}
+
+// BuildIndex lists all directories in parallel & maps actionIDs to the first directory containing them.
+// It's called lazily by Get, but can be called ahead of time to build the index in the background.
+func (ds *DirStore) BuildIndex() {
+	ds.indexOnce.Do(func() {
+		listings := make([][]string, len(ds.Dirs))
+
+		var wg sync.WaitGroup
+		sem := make(chan struct{}, runtime.GOMAXPROCS(0)*2)
+		for i, dir := range ds.Dirs {
+			wg.Add(1)
+			sem <- struct{}{}
+			go func() {
+				defer wg.Done()
+				defer func() { <-sem }()
+
+				actionIDs, err := listActions(dir)
+				if err != nil {
+					if !os.IsNotExist(err) {
+						log.Printf("Warning: error listing cache directory %q: %v", dir, err)
+					}
+					return
+				}
+				listings[i] = actionIDs
+			}()
+		}
+		wg.Wait()
+
+		size := 0
+		for _, actionIDs := range listings {
+			size += len(actionIDs)
+		}
+
+		// Merge in search order so earlier directories take precedence
+		ds.index = make(map[string]string, size)
+		for i, actionIDs := range listings {
+			for _, actionID := range actionIDs {
+				if _, ok := ds.index[actionID]; !ok {
+					ds.index[actionID] = ds.Dirs[i]
+				}
+			}
+		}
+
+		if ds.Verbose {
+			log.Printf("Indexed %d actions in %d cache directories", len(ds.index), len(ds.Dirs))
+		}
+	})
+}
+
+// Look up an entry, optionally counting it as a hit of the serving directory
+func (ds *DirStore) get(actionID string, countHit bool) (outputID, diskPath, dir string, err error) {
+	ds.BuildIndex()
+
+	dir, ok := ds.index[actionID]
+	if !ok {
+		return "", "", "", nil
+	}
+
+	ie, diskPath, ok := readAction(dir, actionID)
+	if !ok {
+		return "", "", "", nil
+	}
+
+	if countHit {
+		ds.hitsMu.Lock()
+		if ds.hits == nil {
+			ds.hits = make(map[string]int64)
+		}
+		ds.hits[dir]++
+		ds.hitsMu.Unlock()
+	}
+
+	diskPath, err = ds.scratch.resolve(ie, diskPath)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	return ie.OutputID, diskPath, dir, nil
+}
+
+func (ds *DirStore) Get(ctx context.Context, actionID string) (outputID, diskPath string, err error) {
+	outputID, diskPath, _, err = ds.GetDir(ctx, actionID)
+	return outputID, diskPath, err
+}
+
+// GetDir is Get additionally returning the input directory serving hits.
+func (ds *DirStore) GetDir(ctx context.Context, actionID string) (outputID, diskPath, dir string, err error) {
+	outputID, diskPath, dir, err = ds.get(actionID, true)
+	if outputID == "" && err == nil && ds.Verbose {
+		log.Printf("dir store miss: %v", actionID)
+	}
+
+	return outputID, diskPath, dir, err
+}
+
+// Hits returns the number of hits served by each directory, including directories without hits.
+func (ds *DirStore) Hits() map[string]int64 {
+	ds.hitsMu.Lock()
+	defer ds.hitsMu.Unlock()
+
+	hits := make(map[string]int64, len(ds.Dirs))
+	for _, dir := range ds.Dirs {
+		hits[dir] = ds.hits[dir]
+	}
+	return hits
+}
+
+func (ds *DirStore) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) (diskPath string, _ error) {
+	return "", ErrReadOnly
+}
+
+func (ds *DirStore) PutDir(ctx context.Context, actionID, outputID string, size int64, body io.Reader) (diskPath, dir string, err error) {
+	return "", "", ErrReadOnly
+}
+
+func (ds *DirStore) Close() error {
+	return ds.scratch.remove()
+}
@@ -0,0 +1,136 @@
+package cachers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testOutputID(output []byte) string {
+	sum := sha256.Sum256(output)
+	return hex.EncodeToString(sum[:])
+}
+
+// Write an action entry & its output to a cache directory
+func writeTestEntry(tb testing.TB, dir, actionID string, output []byte) string {
+	tb.Helper()
+
+	outputID := testOutputID(output)
+
+	ij, err := json.Marshal(&indexEntry{OutputID: outputID, Size: int64(len(output))})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "a-"+actionID), ij, 0o644); err != nil {
+		tb.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "o-"+outputID), output, 0o644); err != nil {
+		tb.Fatal(err)
+	}
+
+	return outputID
+}
+
+// Create numDirs cache directories with actionsPerDir entries each & return the directories & actionIDs
+func testCacheDirs(tb testing.TB, numDirs, actionsPerDir int) (dirs, actionIDs []string) {
+	tb.Helper()
+
+	root := tb.TempDir()
+	for i := range numDirs {
+		dir := filepath.Join(root, fmt.Sprintf("dep-%d", i))
+		if err := os.Mkdir(dir, 0o755); err != nil {
+			tb.Fatal(err)
+		}
+		dirs = append(dirs, dir)
+
+		for j := range actionsPerDir {
+			actionID := fmt.Sprintf("%064x", i*actionsPerDir+j)
+			writeTestEntry(tb, dir, actionID, []byte(actionID))
+			actionIDs = append(actionIDs, actionID)
+		}
+	}
+
+	return dirs, actionIDs
+}
+
+func TestDirStoreGet(t *testing.T) {
+	dirs, actionIDs := testCacheDirs(t, 3, 2)
+
+	// An earlier directory takes precedence over later ones
+	shadowed := writeTestEntry(t, dirs[2], actionIDs[0], []byte("shadowed"))
+
+	ds := &DirStore{Dirs: append(dirs, filepath.Join(t.TempDir(), "missing"))}
+	defer ds.Close()
+
+	for i, actionID := range actionIDs {
+		outputID, diskPath, err := ds.Get(context.Background(), actionID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if outputID == "" || outputID == shadowed {
+			t.Fatalf("Get(%s) = %q, want output from %s", actionID, outputID, dirs[i/2])
+		}
+		if want := filepath.Join(dirs[i/2], "o-"+outputID); diskPath != want {
+			t.Errorf("Get(%s) diskPath = %q, want %q", actionID, diskPath, want)
+		}
+	}
+
+	if outputID, _, err := ds.Get(context.Background(), fmt.Sprintf("%064x", 1000)); outputID != "" || err != nil {
+		t.Errorf("Get() of unknown action = %q, %v, want a miss", outputID, err)
+	}
+
+	hits := ds.Hits()
+	for _, dir := range dirs {
+		if hits[dir] != 2 {
+			t.Errorf("hits of %s = %d, want 2", dir, hits[dir])
+		}
+	}
+}
+
+// Compare indexed gets against probing every directory in order, as DirStore did before indexing.
+// Gets are spread evenly over the directories, so probing stats half of them on average.
+func BenchmarkDirStoreGet(b *testing.B) {
+	const numDirs = 500
+	dirs, actionIDs := testCacheDirs(b, numDirs, 4)
+
+	b.Run("indexed", func(b *testing.B) {
+		ds := &DirStore{Dirs: dirs}
+		defer ds.Close()
+		ds.BuildIndex()
+
+		b.ResetTimer()
+		for i := range b.N {
+			if outputID, _, err := ds.Get(context.Background(), actionIDs[i%len(actionIDs)]); outputID == "" || err != nil {
+				b.Fatalf("miss: %v", err)
+			}
+		}
+	})
+
+	b.Run("index-build", func(b *testing.B) {
+		for range b.N {
+			ds := &DirStore{Dirs: dirs}
+			ds.BuildIndex()
+		}
+	})
+
+	b.Run("probing", func(b *testing.B) {
+		for i := range b.N {
+			actionID := actionIDs[i%len(actionIDs)]
+			found := false
+			for _, dir := range dirs {
+				if _, _, ok := readAction(dir, actionID); ok {
+					found = true
+					break
+				}
+			}
+			if !found {
+				b.Fatal("miss")
+			}
+		}
+	})
+}
@@ -0,0 +1,278 @@
+package cachers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// HTTPCache is a cache backed by a remote HTTP server with local disk write-through.
+//
+// The remote uses a simple REST layout:
+//
+//	GET/PUT /a/<actionID>  JSON index entry like a-<actionID> files on disk
+//	GET/PUT /o/<outputID>  Output contents
+//
+// Hits from the remote are written to Local before being returned,
+// as cmd/go needs outputs as regular files on disk.
+// Puts are written to Local & uploaded in the background.
+type HTTPCache struct {
+	// Base URL of the remote cache, e.g. http://localhost:8080
+	BaseURL string
+
+	// Local cache outputs are written through to
+	Local *DiskCache
+
+	// HTTP client to use, defaults to a client with timeouts
+	Client *http.Client
+
+	// Debug cache hits/misses
+	Verbose bool
+
+	// Wait for in flight uploads to finish on shutdown
+	wg sync.WaitGroup
+}
+
+var _ Cacher = (*HTTPCache)(nil)
+
+// Client used when HTTPCache.Client is nil.
+// An unresponsive remote fails requests instead of stalling builds, like other remote errors they're treated as misses.
+var defaultHTTPClient = &http.Client{
+	Timeout: 2 * time.Minute,
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: 5 * time.Second}).DialContext,
+		TLSHandshakeTimeout:   5 * time.Second,
+		ResponseHeaderTimeout: 10 * time.Second,
+		IdleConnTimeout:       90 * time.Second,
+		MaxIdleConnsPerHost:   16,
+	},
+}
+
+func (hc *HTTPCache) client() *http.Client {
+	if hc.Client != nil {
+		return hc.Client
+	}
+	return defaultHTTPClient
+}
+
+func (hc *HTTPCache) url(kind string, id string) string {
+	return fmt.Sprintf("%s/%s/%s", strings.TrimSuffix(hc.BaseURL, "/"), kind, id)
+}
+
+// Fetch an object from the remote, returning a nil body if it doesn't exist
+func (hc *HTTPCache) fetch(ctx context.Context, kind string, id string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, hc.url(kind, id), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := hc.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Body, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, nil
+	default:
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: %s", hc.url(kind, id), resp.Status)
+	}
+}
+
+func (hc *HTTPCache) upload(ctx context.Context, kind string, id string, size int64, body io.Reader) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, hc.url(kind, id), body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+
+	resp, err := hc.client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("PUT %s: %s", hc.url(kind, id), resp.Status)
+	}
+
+	return nil
+}
+
+var (
+	_ remoteCacher = (*HTTPCache)(nil)
+	_ DirCacher    = (*HTTPCache)(nil)
+)
+
+func (hc *HTTPCache) Get(ctx context.Context, actionID string) (outputID, diskPath string, err error) {
+	outputID, diskPath, _, err = hc.GetDir(ctx, actionID)
+	return outputID, diskPath, err
+}
+
+// GetDir is Get additionally returning the directory of Local or BaseURL for remote hits.
+func (hc *HTTPCache) GetDir(ctx context.Context, actionID string) (outputID, diskPath, dir string, err error) {
+	if outputID, diskPath, dir, err := hc.GetLocal(ctx, actionID); err != nil || outputID != "" {
+		return outputID, diskPath, dir, err
+	}
+	return hc.GetRemote(ctx, actionID)
+}
+
+// GetLocal looks up an entry in Local only.
+func (hc *HTTPCache) GetLocal(ctx context.Context, actionID string) (outputID, diskPath, dir string, err error) {
+	return hc.Local.GetDir(ctx, actionID)
+}
+
+// GetRemote looks up an entry in the remote only & writes hits to Local.
+func (hc *HTTPCache) GetRemote(ctx context.Context, actionID string) (outputID, diskPath, dir string, err error) {
+	// Remote errors are treated as misses so an unavailable remote doesn't fail builds
+	outputID, diskPath, err = hc.getRemote(ctx, actionID)
+	if err != nil {
+		log.Printf("Warning: remote cache error for action %q: %v", actionID, err)
+		return "", "", "", nil
+	}
+
+	if outputID == "" {
+		if hc.Verbose {
+			log.Printf("remote miss: %v", actionID)
+		}
+		return "", "", "", nil
+	}
+
+	return outputID, diskPath, hc.BaseURL, nil
+}
+
+func (hc *HTTPCache) getRemote(ctx context.Context, actionID string) (outputID, diskPath string, err error) {
+	ab, err := hc.fetch(ctx, "a", actionID)
+	if err != nil || ab == nil {
+		return "", "", err
+	}
+	defer ab.Close()
+
+	var ie indexEntry
+	if err := json.NewDecoder(ab).Decode(&ie); err != nil {
+		return "", "", fmt.Errorf("JSON error: %w", err)
+	}
+
+	want, err := hex.DecodeString(ie.OutputID)
+	if err != nil {
+		// Protect against malicious non-hex OutputID from the remote
+		return "", "", fmt.Errorf("invalid OutputID %q", ie.OutputID)
+	}
+	if ie.Size < 0 {
+		return "", "", fmt.Errorf("invalid size %d", ie.Size)
+	}
+
+	ob, err := hc.fetch(ctx, "o", ie.OutputID)
+	if err != nil || ob == nil {
+		return "", "", err
+	}
+	defer ob.Close()
+
+	// Remotes serving a cache directory as is return outputs as stored
+	var body io.Reader = ob
+	switch ie.Compression {
+	case compressionNone:
+	case compressionZstd:
+		zr, err := zstd.NewReader(ob, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return "", "", err
+		}
+		defer zr.Close()
+		body = zr
+	default:
+		return "", "", fmt.Errorf("unsupported compression %q", ie.Compression)
+	}
+
+	// The remote isn't trusted, outputs not matching their entry fail before they're stored
+	checked := &checkedBody{r: body, size: ie.Size, hash: sha256.New(), want: want}
+	if ie.Size == 0 {
+		// Empty outputs aren't read by the local cache
+		if _, err := io.Copy(io.Discard, checked); err != nil {
+			return "", "", err
+		}
+	}
+
+	diskPath, err = hc.Local.Put(ctx, actionID, ie.OutputID, ie.Size, checked)
+	if err != nil {
+		return "", "", err
+	}
+
+	return ie.OutputID, diskPath, nil
+}
+
+func (hc *HTTPCache) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) (diskPath string, _ error) {
+	diskPath, err := hc.Local.Put(ctx, actionID, outputID, size, body)
+	if err != nil {
+		return "", err
+	}
+
+	hc.wg.Add(1)
+	go func() {
+		defer hc.wg.Done()
+
+		// The request context is cancelled once cmd/go has its response
+		if err := hc.putRemote(context.Background(), actionID, outputID, size, diskPath); err != nil {
+			log.Printf("Warning: failed to upload action %q to remote cache: %v", actionID, err)
+		}
+	}()
+
+	return diskPath, nil
+}
+
+// PutDir is Put additionally returning the directory of Local.
+func (hc *HTTPCache) PutDir(ctx context.Context, actionID, outputID string, size int64, body io.Reader) (diskPath, dir string, err error) {
+	diskPath, err = hc.Put(ctx, actionID, outputID, size, body)
+	if err != nil {
+		return "", "", err
+	}
+	return diskPath, hc.Local.Dir, nil
+}
+
+func (hc *HTTPCache) putRemote(ctx context.Context, actionID, outputID string, size int64, diskPath string) error {
+	f, err := os.Open(diskPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := hc.upload(ctx, "o", outputID, size, f); err != nil {
+		return err
+	}
+
+	// Upload the action last so the remote never references a missing output
+	ij, err := json.Marshal(indexEntry{
+		OutputID:  outputID,
+		Size:      size,
+		TimeNanos: hc.Local.timeNanos(),
+	})
+	if err != nil {
+		return err
+	}
+
+	return hc.upload(ctx, "a", actionID, int64(len(ij)), bytes.NewReader(ij))
+}
+
+// Close waits for in-flight uploads & local writes to finish.
+func (hc *HTTPCache) Close() error {
+	hc.wg.Wait()
+	return hc.Local.Close()
+}
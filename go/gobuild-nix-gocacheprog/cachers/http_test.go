@@ -0,0 +1,74 @@
+package cachers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHTTPCacheTamperedRemote(t *testing.T) {
+	ctx := context.Background()
+	remoteDir := t.TempDir()
+
+	valid := writeTestEntry(t, remoteDir, testActionID(1), []byte("valid"))
+
+	// Same size, different contents
+	tampered := writeTestEntry(t, remoteDir, testActionID(2), []byte("original"))
+	if err := os.WriteFile(filepath.Join(remoteDir, "o-"+tampered), []byte("tampered"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Contents shorter than the entry's size
+	truncated := writeTestEntry(t, remoteDir, testActionID(3), []byte("truncated"))
+	if err := os.WriteFile(filepath.Join(remoteDir, "o-"+truncated), []byte("trunc"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// An empty output claiming a non-empty output's ID
+	ij, err := json.Marshal(&indexEntry{OutputID: testOutputID([]byte("not empty")), Size: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(remoteDir, "a-"+testActionID(4)), ij, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(remoteDir, "o-"+testOutputID([]byte("not empty"))), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(&Server{Dir: remoteDir})
+	defer srv.Close()
+
+	localDir := t.TempDir()
+	hc := &HTTPCache{BaseURL: srv.URL, Local: &DiskCache{Dir: localDir}}
+	defer hc.Close()
+
+	if outputID, _, err := hc.Get(ctx, testActionID(1)); err != nil || outputID != valid {
+		t.Fatalf("Get() of valid entry = %q, %v, want %q", outputID, err, valid)
+	}
+
+	for i := 2; i <= 4; i++ {
+		actionID := testActionID(i)
+		if outputID, _, err := hc.Get(ctx, actionID); outputID != "" || err != nil {
+			t.Errorf("Get(%s) of tampered entry = %q, %v, want a miss", actionID, outputID, err)
+		}
+		if exists(localDir, "a-"+actionID) {
+			t.Errorf("tampered entry %s was stored locally", actionID)
+		}
+	}
+
+	// Tampered outputs aren't stored under their claimed ID either
+	for _, outputID := range []string{tampered, truncated} {
+		if b, err := os.ReadFile(filepath.Join(localDir, "o-"+outputID)); err == nil {
+			t.Errorf("tampered output %s was stored locally: %q", outputID, b)
+		}
+	}
+
+	if b, err := os.ReadFile(filepath.Join(localDir, "o-"+valid)); err != nil || !bytes.Equal(b, []byte("valid")) {
+		t.Errorf("valid output wasn't stored locally: %q, %v", b, err)
+	}
+}
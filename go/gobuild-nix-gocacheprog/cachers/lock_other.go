@@ -0,0 +1,32 @@
+//go:build !unix
+
+package cachers
+
+// dirLock is an advisory lock coordinating gocacheprog processes sharing a writable cache directory.
+//
+// File locking isn't implemented on this platform, so trimming isn't safe against concurrent processes.
+type dirLock struct{}
+
+func openDirLock(dir string) (*dirLock, error) {
+	return &dirLock{}, nil
+}
+
+func (l *dirLock) lockShared() error {
+	return nil
+}
+
+func (l *dirLock) lockExclusive() error {
+	return nil
+}
+
+func (l *dirLock) tryLockExclusive() (bool, error) {
+	return true, nil
+}
+
+func (l *dirLock) unlock() error {
+	return nil
+}
+
+func (l *dirLock) close() error {
+	return nil
+}
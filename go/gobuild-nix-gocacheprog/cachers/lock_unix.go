@@ -0,0 +1,58 @@
+//go:build unix
+
+package cachers
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// dirLock is an advisory lock coordinating gocacheprog processes sharing a writable cache directory.
+//
+// Processes using the cache hold a shared lock, trimming requires an exclusive lock.
+type dirLock struct {
+	f *os.File
+}
+
+func openDirLock(dir string) (*dirLock, error) {
+	f, err := os.OpenFile(lockPath(dir), os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &dirLock{f: f}, nil
+}
+
+func (l *dirLock) flock(how int) error {
+	for {
+		err := syscall.Flock(int(l.f.Fd()), how)
+		if !errors.Is(err, syscall.EINTR) {
+			return err
+		}
+	}
+}
+
+func (l *dirLock) lockShared() error {
+	return l.flock(syscall.LOCK_SH)
+}
+
+func (l *dirLock) lockExclusive() error {
+	return l.flock(syscall.LOCK_EX)
+}
+
+// Try to take the exclusive lock without blocking, returning false if another process holds the lock.
+func (l *dirLock) tryLockExclusive() (bool, error) {
+	err := l.flock(syscall.LOCK_EX | syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (l *dirLock) unlock() error {
+	return l.flock(syscall.LOCK_UN)
+}
+
+func (l *dirLock) close() error {
+	return l.f.Close()
+}
@@ -2,6 +2,7 @@ package cachers
 
 import (
 	"bytes"
+	"cmp"
 	"context"
 	"encoding/hex"
 	"encoding/json"
@@ -10,7 +11,10 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // indexEntry is the metadata that DiskCache stores on disk for an ActionID.
@@ -18,72 +22,167 @@ type indexEntry struct {
 	OutputID  string `json:"o"`
 	Size      int64  `json:"n"`
 	TimeNanos int64  `json:"t"`
+
+	// Compression of the output file, empty for uncompressed outputs
+	Compression string `json:"c,omitempty"`
 }
 
+// DiskCache is a writable cache stored in a single directory.
+//
+// Entries are stored as an a-<actionID> JSON index entry pointing to an o-<outputID> file.
 type DiskCache struct {
-	// Cache input directories.
-	// Normally from NIX_GOBUILD_CACHE
-	InputDirs []string
-
-	// Cache output directory path.
-	OutDir string
+	// Cache directory path.
+	// Normally from NIX_GOBUILD_CACHE_OUT
+	Dir string
 
 	// Timestamp to store put requests with.
 	// Normally derived from SOURCE_DATE_EPOCH.
+	// If zero the current time is used.
 	TimeNanos int64
 
+	// Trim least recently used entries on close to keep the cache below this many bytes, zero for no limit
+	MaxSize int64
+
+	// Trim entries not used for longer than this on close, zero for no limit
+	MaxAge time.Duration
+
+	// Compress outputs with zstd
+	Compress bool
+
 	// Debug cache hits/misses
 	Verbose bool
 
-	// Wait for in flight writes to finish on shutdown
-	wg sync.WaitGroup
+	// Uncompressed copies of compressed outputs
+	scratch scratchDir
+
+	// Shared lock held while using a trimmed cache
+	lockOnce sync.Once
+	lock     *dirLock
+	lockErr  error
+
+	// Bytes put, added to the size estimate of the trim marker
+	added atomic.Int64
+
+	// Access times failing to update is only logged once
+	touchWarnOnce sync.Once
 }
 
-func (dc *DiskCache) Get(ctx context.Context, actionID string) (outputID, diskPath string, err error) {
-	filename := fmt.Sprintf("a-%s", actionID)
+var (
+	_ Cacher    = (*DiskCache)(nil)
+	_ DirCacher = (*DiskCache)(nil)
+)
 
-	for _, dir := range dc.InputDirs {
-		actionFile := filepath.Join(dir, filename)
+// Read the action entry for actionID from a cache directory.
+// Unreadable or malformed entries are treated as misses.
+// The returned diskPath is the output file as stored, which may be compressed.
+func readAction(dir string, actionID string) (ie *indexEntry, diskPath string, ok bool) {
+	ij, err := os.ReadFile(filepath.Join(dir, fmt.Sprintf("a-%s", actionID)))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Warning: error reading action %q: %v", actionID, err)
+		}
+		return nil, "", false
+	}
+
+	ie = &indexEntry{}
+	if err := json.Unmarshal(ij, ie); err != nil {
+		log.Printf("Warning: JSON error for action %q: %v", actionID, err)
+		return nil, "", false
+	}
 
-		ij, err := os.ReadFile(actionFile)
+	if _, err := hex.DecodeString(ie.OutputID); err != nil {
+		// Protect against malicious non-hex OutputID on disk
+		return nil, "", false
+	}
+
+	return ie, filepath.Join(dir, fmt.Sprintf("o-%v", ie.OutputID)), true
+}
+
+// Whether the cache is trimmed & needs to track access & coordinate with other processes
+func (dc *DiskCache) trimmed() bool {
+	return dc.MaxSize > 0 || dc.MaxAge > 0
+}
+
+// Take the shared lock of a trimmed cache so other processes don't trim entries in use
+func (dc *DiskCache) acquire() error {
+	if !dc.trimmed() {
+		return nil
+	}
+
+	dc.lockOnce.Do(func() {
+		if err := os.MkdirAll(dc.Dir, 0o755); err != nil {
+			dc.lockErr = err
+			return
+		}
+
+		lock, err := openDirLock(dc.Dir)
 		if err != nil {
-			if os.IsNotExist(err) {
-				continue
-			}
+			dc.lockErr = err
+			return
+		}
 
-			return "", "", nil
+		if err := lock.lockShared(); err != nil {
+			lock.close()
+			dc.lockErr = err
+			return
 		}
 
-		var ie indexEntry
-		if err := json.Unmarshal(ij, &ie); err != nil {
-			log.Printf("Warning: JSON error for action %q: %v", actionID, err)
-			return "", "", nil
+		dc.lock = lock
+	})
+
+	return dc.lockErr
+}
+
+func (dc *DiskCache) Get(ctx context.Context, actionID string) (outputID, diskPath string, err error) {
+	outputID, diskPath, _, err = dc.GetDir(ctx, actionID)
+	return outputID, diskPath, err
+}
+
+// GetDir is Get additionally returning Dir for hits.
+func (dc *DiskCache) GetDir(ctx context.Context, actionID string) (outputID, diskPath, dir string, err error) {
+	if err := dc.acquire(); err != nil {
+		return "", "", "", err
+	}
+
+	ie, diskPath, ok := readAction(dc.Dir, actionID)
+	if ok {
+		if dc.trimmed() {
+			// Record the access for least recently used trimming
+			now := time.Now()
+			if err := os.Chtimes(filepath.Join(dc.Dir, fmt.Sprintf("a-%s", actionID)), now, now); err != nil {
+				dc.touchWarnOnce.Do(func() {
+					log.Printf("Warning: failed to record cache access, trimming may evict entries in use: %v", err)
+				})
+			}
 		}
 
-		if _, err := hex.DecodeString(ie.OutputID); err != nil {
-			// Protect against malicious non-hex OutputID on disk
-			return "", "", nil
+		diskPath, err := dc.scratch.resolve(ie, diskPath)
+		if err != nil {
+			return "", "", "", err
 		}
 
-		return ie.OutputID, filepath.Join(dir, fmt.Sprintf("o-%v", ie.OutputID)), nil
+		return ie.OutputID, diskPath, dc.Dir, nil
 	}
 
 	if dc.Verbose {
 		log.Printf("disk miss: %v", actionID)
 	}
 
-	return "", "", nil
+	return "", "", "", nil
 }
 
 func (dc *DiskCache) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) (diskPath string, _ error) {
-	dc.wg.Add(1)
-	defer dc.wg.Done()
-
-	if dc.OutDir == "" {
+	if dc.Dir == "" {
 		return "", fmt.Errorf("received put but no output directory was set")
 	}
 
-	file := filepath.Join(dc.OutDir, fmt.Sprintf("o-%s", outputID))
+	if err := dc.acquire(); err != nil {
+		return "", err
+	}
+
+	file := filepath.Join(dc.Dir, fmt.Sprintf("o-%s", outputID))
+	diskPath = file
+	compression := compressionNone
 
 	// Special case empty files; they're both common and easier to do race-free.
 	if size == 0 {
@@ -92,6 +191,16 @@ func (dc *DiskCache) Put(ctx context.Context, actionID, outputID string, size in
 			return "", err
 		}
 		zf.Close()
+	} else if dc.Compress && size >= minCompressSize {
+		wrote, plainPath, err := dc.scratch.writeCompressed(file, outputID, body)
+		if err != nil {
+			return "", err
+		}
+		if wrote != size {
+			return "", fmt.Errorf("wrote %d bytes, expected %d", wrote, size)
+		}
+		diskPath = plainPath
+		compression = compressionZstd
 	} else {
 		wrote, err := writeAtomic(file, body)
 		if err != nil {
@@ -103,24 +212,91 @@ func (dc *DiskCache) Put(ctx context.Context, actionID, outputID string, size in
 	}
 
 	ij, err := json.Marshal(indexEntry{
-		OutputID:  outputID,
-		Size:      size,
-		TimeNanos: dc.TimeNanos,
+		OutputID:    outputID,
+		Size:        size,
+		TimeNanos:   dc.timeNanos(),
+		Compression: compression,
 	})
 	if err != nil {
 		return "", err
 	}
 
-	actionFile := filepath.Join(dc.OutDir, fmt.Sprintf("a-%s", actionID))
+	actionFile := filepath.Join(dc.Dir, fmt.Sprintf("a-%s", actionID))
 	if _, err := writeAtomic(actionFile, bytes.NewReader(ij)); err != nil {
 		return "", err
 	}
+	dc.added.Add(size)
 
-	return file, nil
+	return diskPath, nil
 }
 
-func (dc *DiskCache) Wait() {
-	dc.wg.Wait()
+// PutDir is Put additionally returning Dir.
+func (dc *DiskCache) PutDir(ctx context.Context, actionID, outputID string, size int64, body io.Reader) (diskPath, dir string, err error) {
+	diskPath, err = dc.Put(ctx, actionID, outputID, size, body)
+	if err != nil {
+		return "", "", err
+	}
+	return diskPath, dc.Dir, nil
+}
+
+func (dc *DiskCache) timeNanos() int64 {
+	if dc.TimeNanos != 0 {
+		return dc.TimeNanos
+	}
+	return time.Now().UnixNano()
+}
+
+// Close trims the cache if limits are set & a trim is due according to the trim marker.
+//
+// Trimming is skipped while other processes are using the cache, the last one to exit trims it.
+func (dc *DiskCache) Close() error {
+	defer dc.scratch.remove()
+
+	if !dc.trimmed() || dc.lock == nil {
+		return nil
+	}
+	defer dc.lock.close()
+
+	if err := dc.lock.unlock(); err != nil {
+		return err
+	}
+
+	ok, err := dc.lock.tryLockExclusive()
+	if err != nil || !ok {
+		return err
+	}
+	defer dc.lock.unlock()
+
+	opts := TrimOptions{
+		MaxSize: dc.MaxSize,
+		MaxAge:  dc.MaxAge,
+		Now:     time.Now(),
+	}
+
+	// Skip scanning the cache unless a trim is due
+	if m, ok := readTrimMarker(dc.Dir); ok {
+		added := dc.added.Load()
+		m.Size += added
+		if !m.due(opts) {
+			if added == 0 {
+				return nil
+			}
+			if err := writeTrimMarker(dc.Dir, m); err != nil {
+				return fmt.Errorf("error updating trim marker: %w", err)
+			}
+			return nil
+		}
+	}
+
+	res, err := trimLocked(dc.Dir, opts)
+	if err != nil {
+		return fmt.Errorf("error trimming cache: %w", err)
+	}
+	if res.Actions > 0 || res.Outputs > 0 {
+		log.Printf("trimmed %d actions & %d outputs (%d bytes) from %s", res.Actions, res.Outputs, res.Freed, dc.Dir)
+	}
+
+	return nil
 }
 
 func writeAtomic(dest string, r io.Reader) (int64, error) {
@@ -144,3 +320,15 @@ func writeAtomic(dest string, r io.Reader) (int64, error) {
 	}
 	return size, nil
 }
+
+// StoreName strips the store directory & hash from store paths,
+// so reports & traces written to build outputs don't reference the inputs.
+func StoreName(dir string) string {
+	storeDir := cmp.Or(os.Getenv("NIX_STORE"), "/nix/store")
+	if rest, ok := strings.CutPrefix(dir, storeDir+"/"); ok {
+		if _, name, ok := strings.Cut(rest, "-"); ok {
+			return name
+		}
+	}
+	return dir
+}
@@ -0,0 +1,174 @@
+package cachers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// Limit on the size of uploaded action entries
+const maxActionSize = 4096
+
+// Server is a reference HTTP server for HTTPCache storing entries in Dir.
+//
+// Entries use the same a-/o- layout as DiskCache, so a directory served by
+// Server can also be used as a cache directory directly.
+type Server struct {
+	Dir string
+
+	// Log requests
+	Verbose bool
+}
+
+var _ http.Handler = (*Server)(nil)
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	kind, id := filepath.Split(r.URL.Path)
+
+	var prefix string
+	switch kind {
+	case "/a/":
+		prefix = "a-"
+	case "/o/":
+		prefix = "o-"
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	// IDs are always hex, anything else could escape the cache directory
+	if _, err := hex.DecodeString(id); err != nil || id == "" {
+		http.Error(w, "invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	if s.Verbose {
+		log.Printf("%s %s", r.Method, r.URL.Path)
+	}
+
+	path := filepath.Join(s.Dir, prefix+id)
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		f, err := os.Open(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				http.NotFound(w, r)
+			} else {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+		defer f.Close()
+
+		fi, err := f.Stat()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		http.ServeContent(w, r, "", fi.ModTime(), f)
+
+	case http.MethodPut:
+		body := &checkedBody{r: r.Body, size: r.ContentLength}
+		if prefix == "a-" {
+			ij, err := readActionBody(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			body.r = ij
+		} else {
+			body.hash = sha256.New()
+			body.want, _ = hex.DecodeString(id)
+		}
+
+		// Invalid uploads fail before the temporary file is renamed, leaving existing entries alone
+		if _, err := writeAtomic(path, body); err != nil {
+			var uploadErr *uploadError
+			if errors.As(err, &uploadErr) || errors.Is(err, io.ErrUnexpectedEOF) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			} else {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// uploadError is an upload or download not matching its declared size or ID
+type uploadError struct {
+	msg string
+}
+
+func (e *uploadError) Error() string {
+	return e.msg
+}
+
+// checkedBody reads an upload or download & fails at EOF if it doesn't match its declared size,
+// or for outputs if its SHA-256 doesn't match the output ID.
+type checkedBody struct {
+	r io.Reader
+	// Declared size, -1 if unknown
+	size int64
+	read int64
+
+	// Hash of the contents & its expected value, nil for action entries
+	hash hash.Hash
+	want []byte
+}
+
+func (b *checkedBody) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	b.read += int64(n)
+	if b.hash != nil {
+		b.hash.Write(p[:n])
+	}
+
+	if errors.Is(err, io.EOF) {
+		if b.size >= 0 && b.read != b.size {
+			return n, &uploadError{fmt.Sprintf("got %d bytes of declared %d", b.read, b.size)}
+		}
+		if b.hash != nil && !bytes.Equal(b.hash.Sum(nil), b.want) {
+			return n, &uploadError{"output doesn't match its ID"}
+		}
+	}
+
+	return n, err
+}
+
+// Validate an uploaded action entry before it's stored
+func readActionBody(r io.Reader) (io.Reader, error) {
+	ij, err := io.ReadAll(io.LimitReader(r, maxActionSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(ij) > maxActionSize {
+		return nil, fmt.Errorf("action entry too large")
+	}
+
+	var ie indexEntry
+	if err := json.Unmarshal(ij, &ie); err != nil {
+		return nil, fmt.Errorf("invalid action entry: %w", err)
+	}
+	if _, err := hex.DecodeString(ie.OutputID); err != nil || ie.OutputID == "" {
+		return nil, fmt.Errorf("invalid OutputID %q", ie.OutputID)
+	}
+
+	return bytes.NewReader(ij), nil
+}
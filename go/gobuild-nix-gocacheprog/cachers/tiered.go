@@ -0,0 +1,195 @@
+package cachers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync/atomic"
+)
+
+// remoteCacher is implemented by caches querying a remote after a local cache.
+type remoteCacher interface {
+	Cacher
+
+	// GetLocal looks up an entry in the local cache only
+	GetLocal(ctx context.Context, actionID string) (outputID, diskPath, dir string, err error)
+
+	// GetRemote looks up an entry in the remote only
+	GetRemote(ctx context.Context, actionID string) (outputID, diskPath, dir string, err error)
+}
+
+// Tiered combines a writable cache with any number of read-only caches.
+//
+// Gets are looked up in Write first & then in each of Read in order.
+// If Write is backed by a remote, the remote is queried last as it's the most expensive.
+// Puts only go to Write.
+type Tiered struct {
+	// Cache receiving puts, may be nil if puts aren't supported.
+	Write Cacher
+
+	// Caches to look up entries missing from Write.
+	Read []Cacher
+
+	// Copy hits from Read tiers into Write.
+	// Nix builds leave this off so dependency outputs aren't duplicated in $out,
+	// persistent caches turn it on so entries survive garbage collection of the store.
+	Promote bool
+
+	// Debug cache hits/misses
+	Verbose bool
+
+	// Puts not written to Write as a Read tier already provides them
+	Skipped      atomic.Int64
+	SkippedBytes atomic.Int64
+}
+
+var (
+	_ Cacher    = (*Tiered)(nil)
+	_ DirCacher = (*Tiered)(nil)
+)
+
+func (t *Tiered) Get(ctx context.Context, actionID string) (outputID, diskPath string, err error) {
+	outputID, diskPath, _, err = t.GetDir(ctx, actionID)
+	return outputID, diskPath, err
+}
+
+// GetDir is Get additionally returning the cache directory of the tier serving hits.
+// Promoted hits report the read tier they were promoted from.
+func (t *Tiered) GetDir(ctx context.Context, actionID string) (outputID, diskPath, dir string, err error) {
+	// Split a remote backed Write tier so its remote is only queried once all local tiers missed
+	var getWrite, getRemote func(ctx context.Context, actionID string) (string, string, string, error)
+	if rc, ok := t.Write.(remoteCacher); ok {
+		getWrite, getRemote = rc.GetLocal, rc.GetRemote
+	} else if t.Write != nil {
+		getWrite = func(ctx context.Context, actionID string) (string, string, string, error) {
+			return GetDir(ctx, t.Write, actionID)
+		}
+	}
+
+	if getWrite != nil {
+		outputID, diskPath, dir, err := getWrite(ctx, actionID)
+		if err != nil || outputID != "" {
+			return outputID, diskPath, dir, err
+		}
+	}
+
+	for _, c := range t.Read {
+		outputID, diskPath, dir, err := GetDir(ctx, c, actionID)
+		if err != nil {
+			return "", "", "", err
+		}
+		if outputID == "" {
+			continue
+		}
+
+		if t.Promote && t.Write != nil {
+			if promoted, err := t.promote(ctx, actionID, outputID, diskPath); err != nil {
+				log.Printf("Warning: failed to promote action %q: %v", actionID, err)
+			} else {
+				diskPath = promoted
+			}
+		}
+
+		return outputID, diskPath, dir, nil
+	}
+
+	if getRemote != nil {
+		outputID, diskPath, dir, err := getRemote(ctx, actionID)
+		if err != nil || outputID != "" {
+			return outputID, diskPath, dir, err
+		}
+	}
+
+	if t.Verbose {
+		log.Printf("tiered miss: %v", actionID)
+	}
+
+	return "", "", "", nil
+}
+
+// Copy an entry from a read tier into the write tier
+func (t *Tiered) promote(ctx context.Context, actionID, outputID, diskPath string) (string, error) {
+	f, err := os.Open(diskPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	return t.Write.Put(ctx, actionID, outputID, fi.Size(), f)
+}
+
+// Put writes an entry to the write tier.
+//
+// Entries already provided by a read tier with the same outputID, such as outputs of dependencies
+// which were merely recompiled, aren't written again & the read tier's path is returned instead.
+// When promoting the write tier is meant to hold copies, so everything is written.
+func (t *Tiered) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) (diskPath string, _ error) {
+	diskPath, _, err := t.PutDir(ctx, actionID, outputID, size, body)
+	return diskPath, err
+}
+
+// PutDir is Put additionally returning the cache directory of the tier storing or already providing the entry.
+func (t *Tiered) PutDir(ctx context.Context, actionID, outputID string, size int64, body io.Reader) (diskPath, dir string, err error) {
+	if t.Write == nil {
+		return "", "", fmt.Errorf("received put but no writable cache was configured")
+	}
+
+	if existingPath, existingDir, ok := t.provided(ctx, actionID, outputID); ok && !t.Promote {
+		// Read the body anyway so it's validated
+		if _, err := io.Copy(io.Discard, body); err != nil {
+			return "", "", err
+		}
+
+		t.Skipped.Add(1)
+		t.SkippedBytes.Add(size)
+		if t.Verbose {
+			log.Printf("skipping put of %v provided by %v", actionID, existingPath)
+		}
+
+		return existingPath, existingDir, nil
+	}
+
+	return PutDir(ctx, t.Write, actionID, outputID, size, body)
+}
+
+// Look up whether a read tier already has the same action & output
+func (t *Tiered) provided(ctx context.Context, actionID, outputID string) (diskPath, dir string, ok bool) {
+	for _, c := range t.Read {
+		var existingID, existingPath, existingDir string
+		if ds, ok := c.(*DirStore); ok {
+			// Don't count lookups as hits
+			existingID, existingPath, existingDir, _ = ds.get(actionID, false)
+		} else {
+			existingID, existingPath, existingDir, _ = GetDir(ctx, c, actionID)
+		}
+
+		if existingID == outputID {
+			return existingPath, existingDir, true
+		}
+	}
+	return "", "", false
+}
+
+// Close closes the write tier followed by all read tiers.
+func (t *Tiered) Close() error {
+	if skipped := t.Skipped.Load(); skipped > 0 {
+		log.Printf("skipped %d puts (%d bytes) already provided by cache inputs", skipped, t.SkippedBytes.Load())
+	}
+
+	var errs []error
+	if t.Write != nil {
+		errs = append(errs, t.Write.Close())
+	}
+	for _, c := range t.Read {
+		errs = append(errs, c.Close())
+	}
+	return errors.Join(errs...)
+}
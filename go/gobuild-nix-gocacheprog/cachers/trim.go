@@ -0,0 +1,207 @@
+package cachers
+
+import (
+	"cmp"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Outputs without an action entry younger than this may still be in the middle of a put
+const orphanGracePeriod = time.Hour
+
+// TrimOptions configures which entries Trim evicts.
+type TrimOptions struct {
+	// Evict least recently used entries until outputs take up at most this many bytes, zero for no limit
+	MaxSize int64
+
+	// Evict entries not used for longer than this, zero for no limit
+	MaxAge time.Duration
+
+	// Current time, defaults to time.Now()
+	Now time.Time
+}
+
+// TrimResult describes what Trim removed.
+type TrimResult struct {
+	Actions int
+	Outputs int
+	Freed   int64
+
+	// Size of the outputs remaining in the cache
+	Remaining int64
+}
+
+func lockPath(dir string) string {
+	return filepath.Join(dir, ".lock")
+}
+
+// Longest time between full trims of caches limited by size
+const trimInterval = 24 * time.Hour
+
+// trimMarker records the last full trim of a cache directory in trim.txt, like cmd/go's cache.
+//
+// Trimming scans every entry, so closing caches only trims once the size estimate exceeds the limit,
+// entries may have expired or trimInterval has passed.
+type trimMarker struct {
+	Time time.Time
+
+	// Estimated size of the outputs, the remaining size of the last trim plus later puts.
+	// Puts of processes closing while the cache is in use aren't counted, full trims correct the estimate.
+	Size int64
+}
+
+func trimMarkerPath(dir string) string {
+	return filepath.Join(dir, "trim.txt")
+}
+
+// Read the trim marker, ok is false if the directory was never trimmed or the marker is malformed
+func readTrimMarker(dir string) (m trimMarker, ok bool) {
+	b, err := os.ReadFile(trimMarkerPath(dir))
+	if err != nil {
+		return m, false
+	}
+
+	var unix int64
+	if _, err := fmt.Sscanf(string(b), "%d %d\n", &unix, &m.Size); err != nil {
+		return m, false
+	}
+	m.Time = time.Unix(unix, 0)
+
+	return m, true
+}
+
+func writeTrimMarker(dir string, m trimMarker) error {
+	_, err := writeAtomic(trimMarkerPath(dir), strings.NewReader(fmt.Sprintf("%d %d\n", m.Time.Unix(), m.Size)))
+	return err
+}
+
+// Whether a cache with the marker m needs a full trim
+func (m trimMarker) due(opts TrimOptions) bool {
+	since := opts.Now.Sub(m.Time)
+	if since < 0 {
+		// Clock went backwards
+		return true
+	}
+
+	if opts.MaxSize > 0 && (m.Size > opts.MaxSize || since >= trimInterval) {
+		return true
+	}
+
+	// Expired entries are evicted daily, or every MaxAge if that's shorter
+	return opts.MaxAge > 0 && since >= min(opts.MaxAge, trimInterval)
+}
+
+// Last use of an entry, action files are touched on hits in caches tracking access
+func lastUsed(e *Entry) time.Time {
+	if e.ModTime.IsZero() {
+		return time.Unix(0, e.TimeNanos)
+	}
+	return e.ModTime
+}
+
+// Trim evicts least recently used entries of a writable cache directory.
+//
+// It blocks until no other gocacheprog process is using the directory.
+func Trim(dir string, opts TrimOptions) (*TrimResult, error) {
+	lock, err := openDirLock(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.close()
+
+	if err := lock.lockExclusive(); err != nil {
+		return nil, err
+	}
+	defer lock.unlock()
+
+	return trimLocked(dir, opts)
+}
+
+// Trim a directory while holding the exclusive lock & record the trim in its trim marker.
+//
+// Outputs are only removed once no remaining action references them.
+func trimLocked(dir string, opts TrimOptions) (*TrimResult, error) {
+	if opts.Now.IsZero() {
+		opts.Now = time.Now()
+	}
+
+	cd, err := ReadCacheDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &TrimResult{}
+
+	refs := make(map[string]int)
+	for _, e := range cd.Actions {
+		refs[e.OutputID]++
+	}
+
+	removeOutput := func(outputID string) error {
+		if err := os.Remove(filepath.Join(dir, fmt.Sprintf("o-%s", outputID))); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		res.Outputs++
+		res.Freed += cd.Outputs[outputID]
+		delete(cd.Outputs, outputID)
+		return nil
+	}
+
+	// Outputs left behind by removed or failed puts
+	for outputID, modTime := range cd.OutputModTimes {
+		if refs[outputID] == 0 && opts.Now.Sub(modTime) > orphanGracePeriod {
+			if err := removeOutput(outputID); err != nil {
+				return res, err
+			}
+		}
+	}
+
+	var total int64
+	for _, size := range cd.Outputs {
+		total += size
+	}
+
+	// Least recently used first, ties broken by actionID for a stable order
+	actions := slices.SortedFunc(maps.Values(cd.Actions), func(a, b *Entry) int {
+		return cmp.Or(lastUsed(a).Compare(lastUsed(b)), cmp.Compare(a.ActionID, b.ActionID))
+	})
+
+	for _, e := range actions {
+		tooLarge := opts.MaxSize > 0 && total > opts.MaxSize
+		tooOld := opts.MaxAge > 0 && opts.Now.Sub(lastUsed(e)) > opts.MaxAge
+		if !tooLarge && !tooOld {
+			// Entries are ordered by last use, so all remaining entries are newer
+			break
+		}
+
+		if err := os.Remove(filepath.Join(dir, fmt.Sprintf("a-%s", e.ActionID))); err != nil && !os.IsNotExist(err) {
+			return res, err
+		}
+		res.Actions++
+
+		refs[e.OutputID]--
+		if refs[e.OutputID] > 0 {
+			continue
+		}
+
+		if size, ok := cd.Outputs[e.OutputID]; ok {
+			if err := removeOutput(e.OutputID); err != nil {
+				return res, err
+			}
+			total -= size
+		}
+	}
+
+	res.Remaining = total
+
+	if err := writeTrimMarker(dir, trimMarker{Time: opts.Now, Size: total}); err != nil {
+		return res, err
+	}
+
+	return res, nil
+}
@@ -0,0 +1,166 @@
+package cachers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Set the last use of an action
+func touchAction(t *testing.T, dir, actionID string, lastUsed time.Time) {
+	t.Helper()
+	if err := os.Chtimes(filepath.Join(dir, "a-"+actionID), lastUsed, lastUsed); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func exists(dir, name string) bool {
+	_, err := os.Stat(filepath.Join(dir, name))
+	return err == nil
+}
+
+func testActionID(i int) string {
+	return fmt.Sprintf("%064x", i)
+}
+
+func TestTrimSharedOutputs(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+
+	shared := bytes.Repeat([]byte("s"), 100)
+	sharedID := writeTestEntry(t, dir, testActionID(1), shared)
+	writeTestEntry(t, dir, testActionID(2), shared)
+	otherID := writeTestEntry(t, dir, testActionID(3), bytes.Repeat([]byte("o"), 100))
+	for i := range 3 {
+		touchAction(t, dir, testActionID(i+1), now.Add(time.Duration(i-3)*time.Minute))
+	}
+
+	// Evicting the least recently used action keeps the output still referenced by the second
+	res, err := Trim(dir, TrimOptions{MaxSize: 150, Now: now})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Actions != 2 || res.Outputs != 1 || res.Freed != 100 || res.Remaining != 100 {
+		t.Errorf("Trim() = %+v, want 2 actions & 1 output of 100 bytes removed", res)
+	}
+
+	for name, want := range map[string]bool{
+		"a-" + testActionID(1): false,
+		"a-" + testActionID(2): false,
+		"o-" + sharedID:        false,
+		"a-" + testActionID(3): true,
+		"o-" + otherID:         true,
+	} {
+		if exists(dir, name) != want {
+			t.Errorf("%s exists = %v, want %v", name, !want, want)
+		}
+	}
+}
+
+func TestTrimSharedOutputKept(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+
+	shared := bytes.Repeat([]byte("s"), 100)
+	sharedID := writeTestEntry(t, dir, testActionID(1), shared)
+	writeTestEntry(t, dir, testActionID(2), shared)
+	touchAction(t, dir, testActionID(1), now.Add(-48*time.Hour))
+
+	res, err := Trim(dir, TrimOptions{MaxAge: 24 * time.Hour, Now: now})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Actions != 1 || res.Outputs != 0 || res.Remaining != 100 {
+		t.Errorf("Trim() = %+v, want only the expired action removed", res)
+	}
+	if !exists(dir, "o-"+sharedID) || !exists(dir, "a-"+testActionID(2)) {
+		t.Error("output referenced by a remaining action was removed")
+	}
+}
+
+func TestTrimOrphans(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+
+	old := writeTestEntry(t, dir, testActionID(1), []byte("old"))
+	recent := writeTestEntry(t, dir, testActionID(2), []byte("recent"))
+	for _, actionID := range []string{testActionID(1), testActionID(2)} {
+		if err := os.Remove(filepath.Join(dir, "a-"+actionID)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	oldTime := now.Add(-2 * orphanGracePeriod)
+	if err := os.Chtimes(filepath.Join(dir, "o-"+old), oldTime, oldTime); err != nil {
+		t.Fatal(err)
+	}
+
+	// Orphans are removed regardless of limits, unless they may belong to a put in progress
+	res, err := Trim(dir, TrimOptions{MaxSize: 1 << 30, Now: now})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Outputs != 1 || exists(dir, "o-"+old) || !exists(dir, "o-"+recent) {
+		t.Errorf("Trim() = %+v, want only the old orphan removed", res)
+	}
+}
+
+func TestDiskCacheTrimMarker(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	ctx := context.Background()
+
+	writeTestEntry(t, dir, testActionID(1), []byte("expired"))
+	touchAction(t, dir, testActionID(1), now.Add(-2*time.Hour))
+
+	closeCache := func(dc *DiskCache) {
+		t.Helper()
+		// Take the lock like a build using the cache
+		if _, _, err := dc.Get(ctx, testActionID(2)); err != nil {
+			t.Fatal(err)
+		}
+		if err := dc.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A recent trim skips scanning for the expired entry
+	if err := writeTrimMarker(dir, trimMarker{Time: now.Add(-time.Minute), Size: 0}); err != nil {
+		t.Fatal(err)
+	}
+	closeCache(&DiskCache{Dir: dir, MaxAge: time.Hour})
+	if !exists(dir, "a-"+testActionID(1)) {
+		t.Fatal("entry trimmed although a trim wasn't due")
+	}
+
+	// Puts exceeding the size limit make a trim due
+	dc := &DiskCache{Dir: dir, MaxSize: 10, TimeNanos: now.UnixNano()}
+	if _, err := dc.Put(ctx, testActionID(3), testOutputID([]byte("0123456789ab")), 12, bytes.NewReader([]byte("0123456789ab"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := dc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if exists(dir, "a-"+testActionID(1)) {
+		t.Error("least recently used entry not trimmed once the size limit was exceeded")
+	}
+	m, ok := readTrimMarker(dir)
+	if !ok || now.Sub(m.Time) > time.Minute || m.Size != 0 {
+		t.Errorf("trim marker = %+v, %v, want a trim to 0 bytes now", m, ok)
+	}
+
+	// Puts below the limit are added to the estimate without trimming
+	dc = &DiskCache{Dir: dir, MaxSize: 100}
+	if _, err := dc.Put(ctx, testActionID(4), testOutputID([]byte("abc")), 3, bytes.NewReader([]byte("abc"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := dc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if m, _ := readTrimMarker(dir); m.Size != 3 {
+		t.Errorf("trim marker size = %d, want 3", m.Size)
+	}
+}
@@ -6,69 +6,60 @@
 package main
 
 import (
+	"fmt"
 	"github.com/adisbladis/gobuild.nix/go/gobuild-nix-gocacheprog/cacheproc"
 	"github.com/adisbladis/gobuild.nix/go/gobuild-nix-gocacheprog/cachers"
+	"github.com/adisbladis/gobuild.nix/go/gobuild-nix-gocacheprog/record"
+	"github.com/adisbladis/gobuild.nix/go/gobuild-nix-gocacheprog/trace"
 	"log"
 	"os"
-	"strconv"
-	"strings"
 )
 
 func main() {
-	dc := &cachers.DiskCache{}
-
 	// Remove timestamps & extra info from logging
 	log.SetFlags(0)
 	log.SetPrefix("gobuild.nix: ")
 
-	// Output build cache
-	if s := os.Getenv("NIX_GOBUILD_CACHE_VERBOSE"); s != "" {
-		i, err := strconv.Atoi(s)
+	// cmd/go runs GOCACHEPROG without arguments, anything else is a subcommand
+	if len(os.Args) > 1 {
+		var err error
+		switch os.Args[1] {
+		case "serve":
+			err = serveCmd(os.Args[2:])
+		case "trace-diff":
+			err = traceDiffCmd(os.Args[2:])
+		case "compare":
+			err = compareCmd(os.Args[2:])
+		case "inspect":
+			err = inspectCmd(os.Args[2:])
+		case "trim":
+			err = trimCmd(os.Args[2:])
+		case "replay":
+			err = replayCmd(os.Args[2:])
+		default:
+			err = fmt.Errorf("unknown command: %s", os.Args[1])
+		}
 		if err != nil {
 			log.Fatal(err)
 		}
-		dc.Verbose = i > 0
+		return
 	}
 
-	// Directories containing existing build caches
-	if s := os.Getenv("NIX_GOBUILD_CACHE"); s != "" {
-		dirs := strings.Split(s, ":")
-
-		dc.InputDirs = dirs
-
-		if dc.Verbose {
-			log.Printf("Using cache inputs:")
-			for _, dir := range dirs {
-				log.Printf("%v ...", dir)
-			}
-		}
+	cfg, err := configFromEnv()
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	// Output build cache
-	if dir := os.Getenv("NIX_GOBUILD_CACHE_OUT"); dir != "" {
-		dc.OutDir = dir
-
-		if err := os.MkdirAll(dir, 0o755); err != nil {
-			log.Fatal(err)
-		}
-
-		dc.InputDirs = append(dc.InputDirs, dir)
-
-		if dc.Verbose {
-			log.Printf("Using cache output: %v ...", dir)
-		}
+	c, err := newCacher(cfg)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	// Timestamp
-	if s := os.Getenv("SOURCE_DATE_EPOCH"); s != "" {
-		i, err := strconv.ParseInt(s, 10, 64)
-		if err != nil {
+	var backend cachers.Cacher = c
+	if cfg.TraceFile != "" {
+		if backend, err = trace.New(c, cfg.TraceFile); err != nil {
 			log.Fatal(err)
 		}
-		dc.TimeNanos = i * 1_000_000_000
-		if dc.Verbose {
-			log.Printf("Using cache timestamp %v ...", dc.TimeNanos)
-		}
 	}
 
 	var p *cacheproc.Process
@@ -77,16 +68,46 @@ func main() {
 			log.Printf("closing cache; %d gets (%d hits, %d misses, %d errors); %d puts (%d errors)",
 				p.Gets.Load(), p.GetHits.Load(), p.GetMisses.Load(), p.GetErrors.Load(), p.Puts.Load(), p.PutErrors.Load())
 
-			// Wait for in-flight writes to finish
-			dc.Wait()
+			stats := collectStats(p, c)
+			stats.logSummary()
+			if cfg.StatsFile != "" {
+				if err := stats.write(cfg.StatsFile); err != nil {
+					log.Printf("Warning: failed to write cache statistics: %v", err)
+				}
+			}
 
-			return nil
+			// All requests have been answered at this point
+			return backend.Close()
 		},
-		Get: dc.Get,
-		Put: dc.Put,
+		Get:         backend.Get,
+		Put:         backend.Put,
+		Parallelism: cfg.Parallelism,
+	}
+
+	var rec *record.Recorder
+	if cfg.RecordFile != "" {
+		if rec, err = record.Create(cfg.RecordFile); err != nil {
+			log.Fatal(err)
+		}
+		p.Record = rec.Record
 	}
 
 	if err := p.Run(); err != nil {
 		log.Fatal(err)
 	}
+
+	// Metrics are reported after closing, so they include the time spent closing the backend
+	metrics := p.Metrics()
+	logMetrics(metrics)
+	if cfg.MetricsFile != "" {
+		if err := writeMetrics(cfg.MetricsFile, metrics); err != nil {
+			log.Printf("Warning: failed to write cache metrics: %v", err)
+		}
+	}
+
+	if rec != nil {
+		if err := rec.Close(); err != nil {
+			log.Fatal(err)
+		}
+	}
 }
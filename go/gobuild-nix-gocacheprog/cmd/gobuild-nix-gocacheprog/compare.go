@@ -0,0 +1,104 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"text/tabwriter"
+
+	"github.com/adisbladis/gobuild.nix/go/gobuild-nix-gocacheprog/cachers"
+)
+
+// Sum the output sizes of actions
+func entriesSize(entries []*cachers.Entry) int64 {
+	var size int64
+	for _, e := range entries {
+		size += e.Size
+	}
+	return size
+}
+
+// Collect entries of a that aren't in b, sorted by actionID
+func uniqueEntries(a, b *cachers.CacheDir) []*cachers.Entry {
+	var entries []*cachers.Entry
+	for _, actionID := range slices.Sorted(maps.Keys(a.Actions)) {
+		if _, ok := b.Actions[actionID]; !ok {
+			entries = append(entries, a.Actions[actionID])
+		}
+	}
+	return entries
+}
+
+// Compare two cache directories to find nondeterministic actions.
+// Exits with a non-zero status if any action produced different outputs.
+func compareCmd(args []string) error {
+	flags := flag.NewFlagSet("compare", flag.ExitOnError)
+	var verboseFlag = flags.Bool("v", false, "list entries unique to each directory")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s compare [-v] dirA dirB\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	a, err := cachers.ReadCacheDir(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	b, err := cachers.ReadCacheDir(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	var differing []string
+	for _, actionID := range slices.Sorted(maps.Keys(a.Actions)) {
+		if eb, ok := b.Actions[actionID]; ok && eb.OutputID != a.Actions[actionID].OutputID {
+			differing = append(differing, actionID)
+		}
+	}
+
+	onlyA := uniqueEntries(a, b)
+	onlyB := uniqueEntries(b, a)
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	if len(differing) > 0 {
+		fmt.Fprintln(tw, "ACTION\tOUTPUT A\tSIZE A\tOUTPUT B\tSIZE B")
+		for _, actionID := range differing {
+			ea, eb := a.Actions[actionID], b.Actions[actionID]
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%d\n", actionID, ea.OutputID, ea.Size, eb.OutputID, eb.Size)
+		}
+		fmt.Fprintln(tw)
+	}
+
+	if *verboseFlag {
+		for _, side := range []struct {
+			name    string
+			entries []*cachers.Entry
+		}{{"A", onlyA}, {"B", onlyB}} {
+			for _, e := range side.entries {
+				fmt.Fprintf(tw, "only in %s\t%s\t%d\n", side.name, e.ActionID, e.Size)
+			}
+		}
+		fmt.Fprintln(tw)
+	}
+
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Printf("%d actions in both, %d with different outputs\n", len(a.Actions)-len(onlyA), len(differing))
+	fmt.Printf("%d actions (%d bytes) only in %s\n", len(onlyA), entriesSize(onlyA), a.Dir)
+	fmt.Printf("%d actions (%d bytes) only in %s\n", len(onlyB), entriesSize(onlyB), b.Dir)
+
+	if len(differing) > 0 {
+		os.Exit(1)
+	}
+
+	return nil
+}
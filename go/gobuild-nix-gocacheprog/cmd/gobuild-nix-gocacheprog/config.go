@@ -0,0 +1,333 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/adisbladis/gobuild.nix/go/gobuild-nix-gocacheprog/cachers"
+)
+
+// config selects & configures the cache backends.
+// It's read from the environment as cmd/go doesn't pass arguments to GOCACHEPROG.
+type config struct {
+	// Read-only input cache directories (NIX_GOBUILD_CACHE)
+	InputDirs []string
+
+	// Writable output cache directory (NIX_GOBUILD_CACHE_OUT)
+	OutDir string
+
+	// Remote HTTP cache base URL (NIX_GOBUILD_CACHE_REMOTE)
+	Remote string
+
+	// Copy hits from input directories into the output (NIX_GOBUILD_CACHE_PROMOTE)
+	Promote bool
+
+	// Compress new outputs with zstd (NIX_GOBUILD_CACHE_COMPRESS)
+	Compress bool
+
+	// Development shell mode (NIX_GOBUILD_CACHE_DEVSHELL).
+	// New entries go to a persistent user cache directory (NIX_GOBUILD_CACHE_DEVSHELL_DIR) instead of a store output.
+	DevShell bool
+
+	// Trim the output cache to this size on close (NIX_GOBUILD_CACHE_MAX_SIZE)
+	MaxSize int64
+
+	// Trim output cache entries unused for longer than this on close (NIX_GOBUILD_CACHE_MAX_AGE)
+	MaxAge time.Duration
+
+	// Timestamp to store put requests with (SOURCE_DATE_EPOCH)
+	TimeNanos int64
+
+	// Maximum number of concurrently handled requests (NIX_GOBUILD_CACHE_PARALLELISM).
+	// Zero means the cacheproc default.
+	Parallelism int
+
+	// Debug cache hits/misses (NIX_GOBUILD_CACHE_VERBOSE)
+	Verbose bool
+
+	// Path to write the hit attribution report to (NIX_GOBUILD_CACHE_STATS).
+	// Nix builds write the report to $out/nix-support/gobuild-nix/cache-stats.json unless it's set to 0.
+	StatsFile string
+
+	// Path to record a trace of all cache operations to (NIX_GOBUILD_CACHE_TRACE).
+	// When set to 1 in Nix builds the trace is written to $out/nix-support/gobuild-nix/cache.trace.
+	TraceFile string
+
+	// Path to record the request stream from cmd/go to for replaying (NIX_GOBUILD_CACHE_RECORD).
+	// When set to 1 in Nix builds the recording is written to $out/nix-support/gobuild-nix/cache.record.
+	RecordFile string
+
+	// Path to write latency & size metrics to (NIX_GOBUILD_CACHE_METRICS), as OpenMetrics text for .prom & .txt files & JSON otherwise.
+	// When set to 1 in Nix builds the metrics are written to $out/nix-support/gobuild-nix/cache-metrics.jsonl.
+	MetricsFile string
+}
+
+// Default size limit of the persistent dev shell cache
+const defaultDevShellMaxSize = 10 << 30
+
+// Parse a positive size in bytes.
+// Sizes may have a K, M, G or T suffix for multiples of 1024, optionally followed by B, i or iB as in 10GB, 10Gi & 10GiB,
+// or just a B suffix for bytes. Suffixes are case insensitive.
+func parseSize(s string) (int64, error) {
+	num := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	num, binary := strings.CutSuffix(num, "I")
+
+	shift := 0
+	if num != "" {
+		if i := strings.IndexByte("KMGT", num[len(num)-1]); i >= 0 {
+			shift = (i + 1) * 10
+			num = num[:len(num)-1]
+		}
+	}
+	if binary && shift == 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+
+	i, err := strconv.ParseInt(num, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	if i <= 0 {
+		return 0, fmt.Errorf("size %q must be positive", s)
+	}
+	if i > math.MaxInt64>>shift {
+		return 0, fmt.Errorf("size %q is too large", s)
+	}
+
+	return i << shift, nil
+}
+
+// Parse a positive duration, additionally accepting a number of days like 30d
+func parseAge(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		i, err := strconv.ParseInt(days, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid age %q", s)
+		}
+		if i <= 0 {
+			return 0, fmt.Errorf("age %q must be positive", s)
+		}
+		if i > math.MaxInt64/int64(24*time.Hour) {
+			return 0, fmt.Errorf("age %q is too large", s)
+		}
+		return time.Duration(i) * 24 * time.Hour, nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("age %q must be positive", s)
+	}
+	return d, nil
+}
+
+// Get the persistent dev shell cache directory
+func devShellDir() (string, error) {
+	if dir := os.Getenv("NIX_GOBUILD_CACHE_DEVSHELL_DIR"); dir != "" {
+		return dir, nil
+	}
+
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(cacheDir, "gobuild-nix"), nil
+}
+
+func envBool(name string) (bool, error) {
+	s := os.Getenv(name)
+	if s == "" {
+		return false, nil
+	}
+
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		return false, fmt.Errorf("invalid value for %s: %w", name, err)
+	}
+
+	return i > 0, nil
+}
+
+// Read an output file path from an environment variable.
+// 1 selects file in $out/nix-support/gobuild-nix, empty & 0 disable the output.
+func envOutputFile(name, file string) (string, error) {
+	switch value := os.Getenv(name); value {
+	case "", "0":
+		return "", nil
+	case "1":
+		out := os.Getenv("out")
+		if out == "" {
+			return "", fmt.Errorf("%s=1 requires $out to be set, set it to a file path instead", name)
+		}
+		return filepath.Join(out, "nix-support", "gobuild-nix", file), nil
+	default:
+		return value, nil
+	}
+}
+
+// Check whether we're running inside a Nix build, as opposed to a nix-shell/nix develop shell
+func inSandbox() bool {
+	return os.Getenv("NIX_BUILD_TOP") != "" && os.Getenv("IN_NIX_SHELL") == ""
+}
+
+func configFromEnv() (*config, error) {
+	cfg := &config{}
+
+	var err error
+	if cfg.Verbose, err = envBool("NIX_GOBUILD_CACHE_VERBOSE"); err != nil {
+		return nil, err
+	}
+	if cfg.Promote, err = envBool("NIX_GOBUILD_CACHE_PROMOTE"); err != nil {
+		return nil, err
+	}
+	if cfg.DevShell, err = envBool("NIX_GOBUILD_CACHE_DEVSHELL"); err != nil {
+		return nil, err
+	}
+	if cfg.Compress, err = envBool("NIX_GOBUILD_CACHE_COMPRESS"); err != nil {
+		return nil, err
+	}
+
+	// Directories containing existing build caches
+	if s := os.Getenv("NIX_GOBUILD_CACHE"); s != "" {
+		cfg.InputDirs = strings.Split(s, ":")
+	}
+
+	// Output build cache
+	cfg.OutDir = os.Getenv("NIX_GOBUILD_CACHE_OUT")
+	if cfg.DevShell {
+		// Package hooks set NIX_GOBUILD_CACHE_OUT to build outputs, which don't persist in shells
+		if cfg.OutDir, err = devShellDir(); err != nil {
+			return nil, err
+		}
+	}
+
+	// Output size limit
+	if s := os.Getenv("NIX_GOBUILD_CACHE_MAX_SIZE"); s != "" {
+		if cfg.MaxSize, err = parseSize(s); err != nil {
+			return nil, fmt.Errorf("invalid value for NIX_GOBUILD_CACHE_MAX_SIZE: %w", err)
+		}
+	} else if cfg.DevShell {
+		cfg.MaxSize = defaultDevShellMaxSize
+	}
+	if s := os.Getenv("NIX_GOBUILD_CACHE_MAX_AGE"); s != "" {
+		if cfg.MaxAge, err = parseAge(s); err != nil {
+			return nil, fmt.Errorf("invalid value for NIX_GOBUILD_CACHE_MAX_AGE: %w", err)
+		}
+	}
+
+	if s := os.Getenv("NIX_GOBUILD_CACHE_PARALLELISM"); s != "" {
+		if cfg.Parallelism, err = strconv.Atoi(s); err != nil || cfg.Parallelism < 1 {
+			return nil, fmt.Errorf("invalid value for NIX_GOBUILD_CACHE_PARALLELISM: %q", s)
+		}
+	}
+
+	// Remote build cache
+	if remote := os.Getenv("NIX_GOBUILD_CACHE_REMOTE"); remote != "" {
+		if inSandbox() {
+			// The sandbox has no network access & builds must not depend on external state
+			log.Printf("Warning: ignoring NIX_GOBUILD_CACHE_REMOTE inside a Nix build")
+		} else {
+			cfg.Remote = remote
+		}
+	}
+
+	// Reports, traces & recordings
+	if cfg.StatsFile, err = envOutputFile("NIX_GOBUILD_CACHE_STATS", "cache-stats.json"); err != nil {
+		return nil, err
+	}
+	if _, set := os.LookupEnv("NIX_GOBUILD_CACHE_STATS"); !set && inSandbox() && os.Getenv("out") != "" {
+		cfg.StatsFile = filepath.Join(os.Getenv("out"), "nix-support", "gobuild-nix", "cache-stats.json")
+	}
+	if cfg.TraceFile, err = envOutputFile("NIX_GOBUILD_CACHE_TRACE", "cache.trace"); err != nil {
+		return nil, err
+	}
+	if cfg.RecordFile, err = envOutputFile("NIX_GOBUILD_CACHE_RECORD", "cache.record"); err != nil {
+		return nil, err
+	}
+	if cfg.MetricsFile, err = envOutputFile("NIX_GOBUILD_CACHE_METRICS", "cache-metrics.jsonl"); err != nil {
+		return nil, err
+	}
+
+	// Timestamp.
+	// Dev shells set SOURCE_DATE_EPOCH too, but persistent caches need real timestamps for trimming.
+	if s := os.Getenv("SOURCE_DATE_EPOCH"); s != "" && !cfg.DevShell {
+		i, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for SOURCE_DATE_EPOCH: %w", err)
+		}
+		cfg.TimeNanos = i * 1_000_000_000
+	}
+
+	return cfg, nil
+}
+
+// Assemble the cache backends selected by the configuration
+func newCacher(cfg *config) (*cachers.Tiered, error) {
+	tiered := &cachers.Tiered{
+		Promote: cfg.Promote,
+		Verbose: cfg.Verbose,
+	}
+
+	if len(cfg.InputDirs) > 0 {
+		if cfg.Verbose {
+			log.Printf("Using cache inputs:")
+			for _, dir := range cfg.InputDirs {
+				log.Printf("%v ...", dir)
+			}
+		}
+
+		ds := &cachers.DirStore{
+			Dirs:    cfg.InputDirs,
+			Verbose: cfg.Verbose,
+		}
+		tiered.Read = append(tiered.Read, ds)
+
+		// Index input directories while cmd/go is starting up
+		go ds.BuildIndex()
+	}
+
+	if cfg.OutDir != "" {
+		if err := os.MkdirAll(cfg.OutDir, 0o755); err != nil {
+			return nil, err
+		}
+
+		if cfg.Verbose {
+			log.Printf("Using cache output: %v ...", cfg.OutDir)
+			log.Printf("Using cache timestamp %v ...", cfg.TimeNanos)
+		}
+
+		dc := &cachers.DiskCache{
+			Dir:       cfg.OutDir,
+			TimeNanos: cfg.TimeNanos,
+			MaxSize:   cfg.MaxSize,
+			MaxAge:    cfg.MaxAge,
+			Compress:  cfg.Compress,
+			Verbose:   cfg.Verbose,
+		}
+		tiered.Write = dc
+
+		if cfg.Remote != "" {
+			if cfg.Verbose {
+				log.Printf("Using remote cache: %v ...", cfg.Remote)
+			}
+
+			tiered.Write = &cachers.HTTPCache{
+				BaseURL: cfg.Remote,
+				Local:   dc,
+				Verbose: cfg.Verbose,
+			}
+		}
+	} else if cfg.Remote != "" {
+		return nil, fmt.Errorf("NIX_GOBUILD_CACHE_REMOTE requires NIX_GOBUILD_CACHE_OUT to be set for local write-through")
+	}
+
+	return tiered, nil
+}
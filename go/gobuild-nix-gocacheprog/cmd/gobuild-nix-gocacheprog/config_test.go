@@ -0,0 +1,104 @@
+package main
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseSize(t *testing.T) {
+	for _, tt := range []struct {
+		s    string
+		want int64
+	}{
+		{"1", 1},
+		{"512B", 512},
+		{"10k", 10 << 10},
+		{"10M", 10 << 20},
+		{"10G", 10 << 30},
+		{"10GB", 10 << 30},
+		{"10Gi", 10 << 30},
+		{"10GiB", 10 << 30},
+		{" 2t ", 2 << 40},
+		{"8388607T", 8388607 << 40},
+		{"9223372036854775807", math.MaxInt64},
+	} {
+		if got, err := parseSize(tt.s); err != nil || got != tt.want {
+			t.Errorf("parseSize(%q) = %d, %v, want %d", tt.s, got, err, tt.want)
+		}
+	}
+
+	for _, s := range []string{"", "G", "0", "0G", "-1", "-1G", "10i", "10iB", "10X", "10GBB", "8388608T", "9223372036854775808"} {
+		if got, err := parseSize(s); err == nil {
+			t.Errorf("parseSize(%q) = %d, want an error", s, got)
+		}
+	}
+}
+
+func TestParseAge(t *testing.T) {
+	for _, tt := range []struct {
+		s    string
+		want time.Duration
+	}{
+		{"1s", time.Second},
+		{"12h", 12 * time.Hour},
+		{"1h30m", 90 * time.Minute},
+		{"1d", 24 * time.Hour},
+		{"30d", 30 * 24 * time.Hour},
+		{"106751d", 106751 * 24 * time.Hour},
+	} {
+		if got, err := parseAge(tt.s); err != nil || got != tt.want {
+			t.Errorf("parseAge(%q) = %v, %v, want %v", tt.s, got, err, tt.want)
+		}
+	}
+
+	for _, s := range []string{"", "d", "0", "0s", "0d", "-5d", "-1h", "1.5d", "5x", "106752d", "9223372036854775807d", "9223372036854775808d"} {
+		if got, err := parseAge(s); err == nil {
+			t.Errorf("parseAge(%q) = %v, want an error", s, got)
+		}
+	}
+}
+
+func TestConfigStatsFile(t *testing.T) {
+	const out = "/nix/store/00000000000000000000000000000000-out"
+	defaultFile := filepath.Join(out, "nix-support", "gobuild-nix", "cache-stats.json")
+
+	for _, tt := range []struct {
+		name  string
+		env   map[string]string
+		stats string
+		unset bool
+		want  string
+	}{
+		{name: "default in Nix build", env: map[string]string{"NIX_BUILD_TOP": "/build"}, unset: true, want: defaultFile},
+		{name: "disabled in Nix build", env: map[string]string{"NIX_BUILD_TOP": "/build"}, stats: "0", want: ""},
+		{name: "path in Nix build", env: map[string]string{"NIX_BUILD_TOP": "/build"}, stats: "/tmp/stats.json", want: "/tmp/stats.json"},
+		{name: "nix-shell", env: map[string]string{"NIX_BUILD_TOP": "/build", "IN_NIX_SHELL": "impure"}, unset: true, want: ""},
+		{name: "outside of Nix", unset: true, want: ""},
+		{name: "enabled outside of Nix", stats: "1", want: defaultFile},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range []string{"NIX_BUILD_TOP", "IN_NIX_SHELL"} {
+				t.Setenv(name, tt.env[name])
+				if tt.env[name] == "" {
+					os.Unsetenv(name)
+				}
+			}
+			t.Setenv("out", out)
+			t.Setenv("NIX_GOBUILD_CACHE_STATS", tt.stats)
+			if tt.unset {
+				os.Unsetenv("NIX_GOBUILD_CACHE_STATS")
+			}
+
+			cfg, err := configFromEnv()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.StatsFile != tt.want {
+				t.Errorf("StatsFile = %q, want %q", cfg.StatsFile, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/adisbladis/gobuild.nix/go/gobuild-nix-gocacheprog/cachers"
+)
+
+// Number of largest outputs to report per directory
+const largestOutputs = 5
+
+type outputSize struct {
+	OutputID string `json:"outputID"`
+	Size     int64  `json:"size"`
+}
+
+// dirReport summarises a single cache directory
+type dirReport struct {
+	Dir        string `json:"dir"`
+	Actions    int    `json:"actions"`
+	Outputs    int    `json:"outputs"`
+	TotalBytes int64  `json:"totalBytes"`
+
+	// Actions with compressed outputs & the uncompressed size of all outputs
+	Compressed        int   `json:"compressed"`
+	UncompressedBytes int64 `json:"uncompressedBytes"`
+
+	Largest []outputSize `json:"largest"`
+
+	// Outputs not referenced by any action entry
+	Orphaned []string `json:"orphaned"`
+
+	// Actions whose output is missing
+	Dangling []string `json:"dangling"`
+
+	// Actions with unreadable or invalid JSON entries, mapped to the reason
+	Malformed map[string]string `json:"malformed"`
+
+	// Actions with non-hex OutputIDs
+	InvalidOutputIDs map[string]string `json:"invalidOutputIDs"`
+}
+
+func (r *dirReport) problems() int {
+	return len(r.Orphaned) + len(r.Dangling) + len(r.Malformed) + len(r.InvalidOutputIDs)
+}
+
+func inspectDir(dir string) (*dirReport, error) {
+	cd, err := cachers.ReadCacheDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &dirReport{
+		Dir:              dir,
+		Actions:          len(cd.Actions),
+		Outputs:          len(cd.Outputs),
+		Largest:          []outputSize{},
+		Orphaned:         []string{},
+		Dangling:         []string{},
+		Malformed:        cd.Malformed,
+		InvalidOutputIDs: cd.InvalidOutputIDs,
+	}
+
+	referenced := make(map[string]bool)
+	for _, actionID := range slices.Sorted(maps.Keys(cd.Actions)) {
+		e := cd.Actions[actionID]
+		if e.Compression != "" {
+			r.Compressed++
+		}
+		if !referenced[e.OutputID] {
+			r.UncompressedBytes += e.Size
+		}
+		referenced[e.OutputID] = true
+		if _, ok := cd.Outputs[e.OutputID]; !ok {
+			r.Dangling = append(r.Dangling, actionID)
+		}
+	}
+
+	for _, outputID := range slices.Sorted(maps.Keys(cd.Outputs)) {
+		size := cd.Outputs[outputID]
+		r.TotalBytes += size
+		r.Largest = append(r.Largest, outputSize{OutputID: outputID, Size: size})
+		if !referenced[outputID] {
+			r.Orphaned = append(r.Orphaned, outputID)
+		}
+	}
+
+	slices.SortStableFunc(r.Largest, func(a, b outputSize) int {
+		return cmp.Compare(b.Size, a.Size)
+	})
+	r.Largest = r.Largest[:min(largestOutputs, len(r.Largest))]
+
+	return r, nil
+}
+
+func (r *dirReport) writeText() {
+	fmt.Printf("%s\n", r.Dir)
+	fmt.Printf("  %d actions, %d outputs, %d bytes\n", r.Actions, r.Outputs, r.TotalBytes)
+	if r.Compressed > 0 {
+		fmt.Printf("  %d actions compressed, %d bytes uncompressed\n", r.Compressed, r.UncompressedBytes)
+	}
+
+	if len(r.Largest) > 0 {
+		fmt.Printf("  largest outputs:\n")
+		for _, o := range r.Largest {
+			fmt.Printf("    %12d %s\n", o.Size, o.OutputID)
+		}
+	}
+
+	for _, outputID := range r.Orphaned {
+		fmt.Printf("  orphaned output %s\n", outputID)
+	}
+	for _, actionID := range r.Dangling {
+		fmt.Printf("  dangling action %s\n", actionID)
+	}
+	for _, actionID := range slices.Sorted(maps.Keys(r.Malformed)) {
+		fmt.Printf("  malformed action %s: %s\n", actionID, r.Malformed[actionID])
+	}
+	for _, actionID := range slices.Sorted(maps.Keys(r.InvalidOutputIDs)) {
+		fmt.Printf("  action %s has non-hex OutputID %q\n", actionID, r.InvalidOutputIDs[actionID])
+	}
+}
+
+// Summarise cache directories.
+// Without arguments the directories in NIX_GOBUILD_CACHE are inspected.
+func inspectCmd(args []string) error {
+	flags := flag.NewFlagSet("inspect", flag.ExitOnError)
+	var jsonFlag = flags.Bool("json", false, "output JSON")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s inspect [-json] [dir or search path...]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	var dirs []string
+	for _, arg := range flags.Args() {
+		dirs = append(dirs, filepath.SplitList(arg)...)
+	}
+	if len(dirs) == 0 {
+		if s := os.Getenv("NIX_GOBUILD_CACHE"); s != "" {
+			dirs = strings.Split(s, ":")
+		}
+	}
+	if len(dirs) == 0 {
+		return fmt.Errorf("inspect: no directories given and NIX_GOBUILD_CACHE is not set")
+	}
+
+	reports := make([]*dirReport, 0, len(dirs))
+	for _, dir := range dirs {
+		r, err := inspectDir(dir)
+		if err != nil {
+			return err
+		}
+		reports = append(reports, r)
+	}
+
+	if *jsonFlag {
+		je := json.NewEncoder(os.Stdout)
+		je.SetIndent("", "  ")
+		return je.Encode(reports)
+	}
+
+	var actions, problems int
+	var totalBytes int64
+	for _, r := range reports {
+		r.writeText()
+		actions += r.Actions
+		totalBytes += r.TotalBytes
+		problems += r.problems()
+	}
+
+	if len(reports) > 1 {
+		fmt.Printf("\n%d directories, %d actions, %d bytes, %d problems\n", len(reports), actions, totalBytes, problems)
+	}
+
+	return nil
+}
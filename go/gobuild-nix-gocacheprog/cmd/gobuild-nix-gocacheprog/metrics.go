@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/adisbladis/gobuild.nix/go/gobuild-nix-gocacheprog/cacheproc"
+)
+
+// Format a quantile of s, quantiles above all bounds are only known to be larger than the largest bound
+func formatQuantile(s cacheproc.HistogramSnapshot, q float64) string {
+	le, ok := s.Quantile(q)
+	if !ok {
+		return fmt.Sprintf("> %v", le)
+	}
+	return fmt.Sprintf("<= %v", le)
+}
+
+// Log latencies, transferred bytes & where time was spent
+func logMetrics(m *cacheproc.Metrics) {
+	for _, h := range []struct {
+		name string
+		s    cacheproc.HistogramSnapshot
+	}{{"get", m.Get}, {"put", m.Put}} {
+		if h.s.Count == 0 {
+			continue
+		}
+		log.Printf("%s latency: mean %v, p50 %s, p90 %s, p99 %s",
+			h.name, h.s.Mean().Round(time.Microsecond), formatQuantile(h.s, 0.5), formatQuantile(h.s, 0.9), formatQuantile(h.s, 0.99))
+	}
+
+	log.Printf("served %d bytes, stored %d bytes; %v in cache backends & %v in protocol I/O summed over requests, %v closing",
+		m.BytesServed, m.BytesStored, m.DiskTime.Round(time.Millisecond), m.ProtocolTime.Round(time.Millisecond), m.CloseTime.Round(time.Millisecond))
+
+	if len(m.Largest) > 0 {
+		log.Printf("largest object: %d bytes (%s)", m.Largest[0].Size, m.Largest[0].OutputID)
+	}
+}
+
+// Write metrics to path, as OpenMetrics text for .prom & .txt files & JSON otherwise.
+//
+// A build runs cmd/go several times, so JSON metrics are appended as one line per cache process.
+// OpenMetrics files are an exposition of the latest cache process & replaced atomically for scrapers,
+// which treat the counters starting over as a reset.
+func writeMetrics(path string, m *cacheproc.Metrics) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	switch filepath.Ext(path) {
+	case ".prom", ".txt":
+		var buf bytes.Buffer
+		writeOpenMetrics(&buf, m)
+		return writeFileAtomic(path, buf.Bytes())
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Encode writes the line at once, so lines of concurrent processes don't interleave
+	if err := json.NewEncoder(f).Encode(m); err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+func formatSeconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'g', -1, 64)
+}
+
+// Write metrics in the OpenMetrics text exposition format
+func writeOpenMetrics(w io.Writer, m *cacheproc.Metrics) {
+	const prefix = "gobuild_nix_cache_"
+
+	histogram := func(name, help string, s cacheproc.HistogramSnapshot) {
+		name = prefix + name
+		fmt.Fprintf(w, "# TYPE %s histogram\n# UNIT %s seconds\n# HELP %s %s\n", name, name, name, help)
+		for _, b := range s.Buckets {
+			fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, formatSeconds(b.LE), b.Count)
+		}
+		fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, s.Count)
+		fmt.Fprintf(w, "%s_count %d\n%s_sum %s\n", name, s.Count, name, formatSeconds(s.Sum))
+	}
+	counter := func(name, unit, help, value string) {
+		name = prefix + name
+		fmt.Fprintf(w, "# TYPE %s counter\n# UNIT %s %s\n# HELP %s %s\n%s_total %s\n", name, name, unit, name, help, name, value)
+	}
+
+	histogram("get_duration_seconds", "Latency of get requests.", m.Get)
+	histogram("put_duration_seconds", "Latency of put requests.", m.Put)
+	counter("served_bytes", "bytes", "Bytes returned by get hits.", strconv.FormatInt(m.BytesServed, 10))
+	counter("stored_bytes", "bytes", "Bytes accepted by puts.", strconv.FormatInt(m.BytesStored, 10))
+	counter("disk_seconds", "seconds", "Time spent in cache backends, summed over concurrent requests.", formatSeconds(m.DiskTime))
+	counter("protocol_seconds", "seconds", "Time spent decoding put bodies & writing responses, summed over concurrent requests.", formatSeconds(m.ProtocolTime))
+	counter("close_seconds", "seconds", "Time spent closing cache backends.", formatSeconds(m.CloseTime))
+
+	name := prefix + "largest_object_bytes"
+	fmt.Fprintf(w, "# TYPE %s gauge\n# UNIT %s bytes\n# HELP %s Sizes of the largest objects served or stored.\n", name, name, name)
+	for _, o := range m.Largest {
+		fmt.Fprintf(w, "%s{output_id=\"%s\"} %d\n", name, o.OutputID, o.Size)
+	}
+
+	fmt.Fprintf(w, "# EOF\n")
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+
+	"github.com/adisbladis/gobuild.nix/go/gobuild-nix-gocacheprog/cacheproc"
+	"github.com/adisbladis/gobuild.nix/go/gobuild-nix-gocacheprog/cacheproc/client"
+	"github.com/adisbladis/gobuild.nix/go/gobuild-nix-gocacheprog/record"
+)
+
+func printLatency(name string, l record.Latency) {
+	if l.Count == 0 {
+		return
+	}
+	fmt.Printf("%-4s %8d requests  p50 %-12v p90 %-12v p99 %-12v max %v\n", name, l.Count, l.P50, l.P90, l.P99, l.Max)
+}
+
+// Replay a recorded request stream against an in-process cache backend.
+func replayCmd(args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	var inputDirs []string
+	flags.Func("in", "read-only cache input directory (may be repeated)", func(s string) error {
+		inputDirs = append(inputDirs, s)
+		return nil
+	})
+	var outFlag = flags.String("out", "", "cache output directory (defaults to a temporary directory)")
+	var compressFlag = flags.Bool("compress", false, "compress new outputs")
+	var parallelismFlag = flags.Int("parallelism", 0, "maximum number of requests handled concurrently by the cache")
+	var concurrencyFlag = flags.Int("concurrency", runtime.GOMAXPROCS(0), "maximum number of requests in flight")
+	var jsonFlag = flags.Bool("json", false, "output JSON")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s replay [flags] recording\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	entries, err := record.Read(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	cfg := &config{
+		InputDirs: inputDirs,
+		OutDir:    *outFlag,
+		Compress:  *compressFlag,
+	}
+	if cfg.OutDir == "" {
+		if cfg.OutDir, err = os.MkdirTemp("", "gobuild-nix-replay-"); err != nil {
+			return err
+		}
+		defer os.RemoveAll(cfg.OutDir)
+	}
+
+	c, err := newCacher(cfg)
+	if err != nil {
+		return err
+	}
+
+	p := &cacheproc.Process{
+		Get:         c.Get,
+		Put:         c.Put,
+		Close:       c.Close,
+		Parallelism: *parallelismFlag,
+	}
+
+	// Connect a client to the process in-process
+	reqR, reqW := io.Pipe()
+	resR, resW := io.Pipe()
+	ctx := context.Background()
+	done := make(chan error, 1)
+	go func() {
+		done <- p.RunIO(ctx, reqR, resW)
+		resW.Close()
+	}()
+
+	cl, err := client.New(resR, reqW)
+	if err != nil {
+		return err
+	}
+
+	res, err := record.Replay(ctx, cl, entries, *concurrencyFlag)
+	if err != nil {
+		return err
+	}
+	if err := <-done; err != nil {
+		return err
+	}
+
+	if *jsonFlag {
+		je := json.NewEncoder(os.Stdout)
+		je.SetIndent("", "  ")
+		return je.Encode(res)
+	}
+
+	fmt.Printf("%d requests in %v (%.0f requests/s), close took %v\n", res.Requests, res.Duration, res.Throughput(), res.CloseTime)
+	fmt.Printf("%d hits, %d misses (%.1f%% hit rate), %d errors, %d bytes put\n", res.Hits, res.Misses, res.HitRate()*100, res.Errors, res.PutBytes)
+	printLatency("get", res.Get)
+	printLatency("put", res.Put)
+
+	return nil
+}
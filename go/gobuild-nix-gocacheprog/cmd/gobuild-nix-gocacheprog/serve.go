@@ -0,0 +1,35 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/adisbladis/gobuild.nix/go/gobuild-nix-gocacheprog/cachers"
+)
+
+// Serve a cache directory for use with NIX_GOBUILD_CACHE_REMOTE
+func serveCmd(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	var dirFlag = flags.String("dir", "", "cache directory to serve")
+	var listenFlag = flags.String("listen", "localhost:8080", "address to listen on")
+	var verboseFlag = flags.Bool("verbose", false, "log requests")
+	flags.Parse(args)
+
+	if *dirFlag == "" {
+		return fmt.Errorf("serve: -dir is required")
+	}
+
+	if err := os.MkdirAll(*dirFlag, 0o755); err != nil {
+		return err
+	}
+
+	log.Printf("Serving %s on http://%s", *dirFlag, *listenFlag)
+
+	return http.ListenAndServe(*listenFlag, &cachers.Server{
+		Dir:     *dirFlag,
+		Verbose: *verboseFlag,
+	})
+}
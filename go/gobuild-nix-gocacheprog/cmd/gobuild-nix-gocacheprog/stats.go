@@ -0,0 +1,165 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/adisbladis/gobuild.nix/go/gobuild-nix-gocacheprog/cacheproc"
+	"github.com/adisbladis/gobuild.nix/go/gobuild-nix-gocacheprog/cachers"
+)
+
+// Number of top contributing input directories to log on close
+const topContributors = 5
+
+type inputStats struct {
+	Dir  string `json:"dir"`
+	Hits int64  `json:"hits"`
+}
+
+// cacheStats attributes cache hits to the input directories serving them
+type cacheStats struct {
+	Gets      int64 `json:"gets"`
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	GetErrors int64 `json:"getErrors"`
+	Puts      int64 `json:"puts"`
+	PutErrors int64 `json:"putErrors"`
+
+	// Hits not served by an input directory, i.e. outputs of the current build
+	OutputHits int64 `json:"outputHits"`
+
+	// Input directories ordered by hits, directories without hits included.
+	// Reports written to a file name store paths without the store directory & hash.
+	Inputs []inputStats `json:"inputs"`
+}
+
+func collectStats(p *cacheproc.Process, t *cachers.Tiered) *cacheStats {
+	stats := &cacheStats{
+		Gets:      p.Gets.Load(),
+		Hits:      p.GetHits.Load(),
+		Misses:    p.GetMisses.Load(),
+		GetErrors: p.GetErrors.Load(),
+		Puts:      p.Puts.Load(),
+		PutErrors: p.PutErrors.Load(),
+		Inputs:    []inputStats{},
+	}
+
+	var inputHits int64
+	for _, c := range t.Read {
+		if ds, ok := c.(*cachers.DirStore); ok {
+			for dir, hits := range ds.Hits() {
+				stats.Inputs = append(stats.Inputs, inputStats{Dir: dir, Hits: hits})
+				inputHits += hits
+			}
+		}
+	}
+	stats.OutputHits = stats.Hits - inputHits
+
+	slices.SortFunc(stats.Inputs, func(a, b inputStats) int {
+		return cmp.Or(cmp.Compare(b.Hits, a.Hits), cmp.Compare(a.Dir, b.Dir))
+	})
+
+	return stats
+}
+
+// Add the counters & hits of other, with input directories by name
+func (s *cacheStats) merge(other *cacheStats) {
+	s.Gets += other.Gets
+	s.Hits += other.Hits
+	s.Misses += other.Misses
+	s.GetErrors += other.GetErrors
+	s.Puts += other.Puts
+	s.PutErrors += other.PutErrors
+	s.OutputHits += other.OutputHits
+
+	hits := make(map[string]int64, len(s.Inputs))
+	for _, input := range s.Inputs {
+		hits[input.Dir] += input.Hits
+	}
+	for _, input := range other.Inputs {
+		hits[cachers.StoreName(input.Dir)] += input.Hits
+	}
+
+	s.Inputs = make([]inputStats, 0, len(hits))
+	for dir, n := range hits {
+		s.Inputs = append(s.Inputs, inputStats{Dir: dir, Hits: n})
+	}
+	slices.SortFunc(s.Inputs, func(a, b inputStats) int {
+		return cmp.Or(cmp.Compare(b.Hits, a.Hits), cmp.Compare(a.Dir, b.Dir))
+	})
+}
+
+// Add the statistics to the report at path.
+// A build runs cmd/go several times, so an existing report is merged with instead of overwritten.
+func (s *cacheStats) write(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	report := &cacheStats{}
+	if b, err := os.ReadFile(path); err == nil {
+		if err := json.Unmarshal(b, report); err != nil {
+			return fmt.Errorf("reading existing report %s: %w", path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	report.merge(s)
+
+	b, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, append(b, '\n'))
+}
+
+// Write a file by renaming a temporary file, so concurrent readers never see partial contents
+func writeFileAtomic(path string, b []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(0o644); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// Log the top contributing input directories & how many were never used
+func (s *cacheStats) logSummary() {
+	if len(s.Inputs) == 0 {
+		return
+	}
+
+	unused := 0
+	for _, input := range s.Inputs {
+		if input.Hits == 0 {
+			unused++
+		}
+	}
+
+	log.Printf("cache hits by input (%d misses, %d of %d inputs unused):", s.Misses, unused, len(s.Inputs))
+	for _, input := range s.Inputs[:min(topContributors, len(s.Inputs))] {
+		if input.Hits == 0 {
+			break
+		}
+		log.Printf("  %6d %s", input.Hits, input.Dir)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/adisbladis/gobuild.nix/go/gobuild-nix-gocacheprog/trace"
+)
+
+func describeResult(in bool, hit bool, dir string) string {
+	switch {
+	case !in:
+		return "-"
+	case hit:
+		return "hit " + dir
+	default:
+		return "miss"
+	}
+}
+
+// Compare the gets of two traces
+func traceDiffCmd(args []string) error {
+	flags := flag.NewFlagSet("trace-diff", flag.ExitOnError)
+	var allFlag = flags.Bool("all", false, "also show actions only requested in one of the traces")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s trace-diff [-all] a.trace b.trace\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	a, err := trace.Read(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	b, err := trace.Read(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	var missedA, missedB, onlyA, onlyB int
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ACTION\tA\tB")
+	for _, e := range trace.Diff(a, b) {
+		switch {
+		case !e.InB:
+			onlyA++
+		case !e.InA:
+			onlyB++
+		case e.HitB:
+			missedA++
+		default:
+			missedB++
+		}
+
+		if (!e.InA || !e.InB) && !*allFlag {
+			continue
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", e.ActionID, describeResult(e.InA, e.HitA, e.DirA), describeResult(e.InB, e.HitB, e.DirB))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Printf("\n%d actions missed in A but hit in B, %d missed in B but hit in A\n", missedA, missedB)
+	fmt.Printf("%d actions only requested in A, %d only in B\n", onlyA, onlyB)
+
+	return nil
+}
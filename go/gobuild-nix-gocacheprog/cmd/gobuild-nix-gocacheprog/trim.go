@@ -0,0 +1,62 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/adisbladis/gobuild.nix/go/gobuild-nix-gocacheprog/cachers"
+)
+
+// Evict least recently used entries from a writable cache directory.
+// Without arguments the dev shell cache is trimmed.
+func trimCmd(args []string) error {
+	flags := flag.NewFlagSet("trim", flag.ExitOnError)
+	var maxSizeFlag = flags.String("max-size", "", "evict least recently used entries until the cache is at most this size (e.g. 2G)")
+	var maxAgeFlag = flags.String("max-age", "", "evict entries unused for longer than this (e.g. 30d or 12h)")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s trim [-max-size size] [-max-age age] [dir]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	opts := cachers.TrimOptions{}
+	if *maxSizeFlag != "" {
+		size, err := parseSize(*maxSizeFlag)
+		if err != nil {
+			return fmt.Errorf("invalid -max-size: %w", err)
+		}
+		opts.MaxSize = size
+	}
+	if *maxAgeFlag != "" {
+		age, err := parseAge(*maxAgeFlag)
+		if err != nil {
+			return fmt.Errorf("invalid -max-age: %w", err)
+		}
+		opts.MaxAge = age
+	}
+	if opts.MaxSize == 0 && opts.MaxAge == 0 {
+		return fmt.Errorf("trim: at least one of -max-size or -max-age is required")
+	}
+
+	dir := flags.Arg(0)
+	if dir == "" {
+		var err error
+		if dir, err = devShellDir(); err != nil {
+			return err
+		}
+	}
+
+	start := time.Now()
+	res, err := cachers.Trim(dir, opts)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("trimmed %d actions & %d outputs (%d bytes) from %s in %v, %d bytes remaining",
+		res.Actions, res.Outputs, res.Freed, dir, time.Since(start).Round(time.Millisecond), res.Remaining)
+
+	return nil
+}
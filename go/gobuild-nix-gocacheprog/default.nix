@@ -1,13 +1,23 @@
 { stdenv, go }:
 stdenv.mkDerivation {
   name = "gobuild-nix-gocacheprog";
+  # Dependencies are vendored in ./vendor.
+  # gocacheprog is used to build package sets, so it can't be built from one,
+  # & fetching modules by hash would tie the hash to the Go version.
   src = ./.;
+  env = {
+    GOSUMDB = "off";
+    GOPROXY = "off";
+    GOFLAGS = "-mod=vendor";
+  };
   nativeBuildInputs = [
     go
   ];
+  preConfigure = ''
+    export HOME=$TMPDIR
+  '';
   installPhase = ''
     runHook preInstall
-    export HOME=$TMPDIR
     env GOMAXPROCS=$NIX_BUILD_CORES GOBIN="$out/bin" go install -v ./...
     runHook postInstall
   '';
@@ -1,3 +1,5 @@
 module github.com/adisbladis/gobuild.nix/go/gobuild-nix-gocacheprog
 
 go 1.24
+
+require github.com/klauspost/compress v1.18.0
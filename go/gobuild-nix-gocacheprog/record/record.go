@@ -0,0 +1,103 @@
+// Package record captures the request stream cmd/go sends to GOCACHEPROG & replays it
+// for benchmarking cache backends.
+//
+// Recordings are JSON lines files with one Entry per request.
+// A build runs cmd/go several times, so requests of each cache process are appended to the same recording.
+// Put bodies are not recorded, their SHA-256 is the OutputID which is verified while reading.
+package record
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/adisbladis/gobuild.nix/go/gobuild-nix-gocacheprog/wire"
+)
+
+// Entry is a single recorded request.
+type Entry struct {
+	wire.Request
+
+	// Time the request was read relative to the start of the cache process
+	Start time.Duration `json:"t"`
+}
+
+// Recorder writes requests to a recording file.
+type Recorder struct {
+	start time.Time
+
+	mu sync.Mutex
+	f  *os.File
+	bw *bufio.Writer
+	je *json.Encoder
+}
+
+// Create a recording at path or append to an existing one.
+func Create(path string) (*Recorder, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	bw := bufio.NewWriter(f)
+	return &Recorder{
+		start: time.Now(),
+		f:     f,
+		bw:    bw,
+		je:    json.NewEncoder(bw),
+	}, nil
+}
+
+// Record appends req to the recording.
+// It's meant to be used as cacheproc.Process.Record.
+func (r *Recorder) Record(req *wire.Request) {
+	e := &Entry{
+		Request: *req,
+		Start:   time.Since(r.start),
+	}
+	e.Body = nil
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.je.Encode(e)
+}
+
+// Close flushes & closes the recording.
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return errors.Join(r.bw.Flush(), r.f.Close())
+}
+
+// Read all entries from a recording file.
+func Read(path string) ([]*Entry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []*Entry
+	jd := json.NewDecoder(bufio.NewReader(f))
+	for {
+		e := &Entry{}
+		if err := jd.Decode(e); err != nil {
+			if errors.Is(err, io.EOF) {
+				return entries, nil
+			}
+			return nil, fmt.Errorf("error reading recording %s: %w", path, err)
+		}
+		entries = append(entries, e)
+	}
+}
@@ -0,0 +1,126 @@
+package record
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/adisbladis/gobuild.nix/go/gobuild-nix-gocacheprog/cacheproc"
+	"github.com/adisbladis/gobuild.nix/go/gobuild-nix-gocacheprog/cacheproc/client"
+	"github.com/adisbladis/gobuild.nix/go/gobuild-nix-gocacheprog/cachers"
+	"github.com/adisbladis/gobuild.nix/go/gobuild-nix-gocacheprog/wire"
+)
+
+// Connect a client to p running in-process, the returned channel yields the result of RunIO
+func connect(t *testing.T, p *cacheproc.Process) (*client.Client, <-chan error) {
+	t.Helper()
+
+	reqR, reqW := io.Pipe()
+	resR, resW := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := p.RunIO(context.Background(), reqR, resW)
+		reqR.CloseWithError(io.ErrClosedPipe)
+		resW.Close()
+		done <- err
+	}()
+
+	c, err := client.New(resR, reqW)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c, done
+}
+
+func diskCacheProcess(t *testing.T) *cacheproc.Process {
+	dc := &cachers.DiskCache{Dir: t.TempDir()}
+	return &cacheproc.Process{Get: dc.Get, Put: dc.Put, Close: dc.Close}
+}
+
+// A cache writing puts slowly after their body was read, so later requests are handled before the put finished
+func slowPutProcess(t *testing.T) *cacheproc.Process {
+	p := diskCacheProcess(t)
+	put := p.Put
+	p.Put = func(ctx context.Context, actionID, outputID string, size int64, body io.Reader) (string, error) {
+		b, err := io.ReadAll(body)
+		if err != nil {
+			return "", err
+		}
+		time.Sleep(time.Millisecond)
+		return put(ctx, actionID, outputID, size, bytes.NewReader(b))
+	}
+	return p
+}
+
+func TestRecordReplay(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "cache.record")
+
+	rec, err := Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := diskCacheProcess(t)
+	p.Record = rec.Record
+	c, done := connect(t, p)
+
+	// Like cmd/go, each action misses, is put & hits when it's needed again
+	const n = 50
+	for i := range n {
+		actionID := fmt.Sprintf("%064x", i)
+		body := bytes.Repeat([]byte(actionID), i%3)
+		outputID := fmt.Sprintf("%x", sha256.Sum256(body))
+
+		if res, err := c.Get(ctx, actionID); err != nil || !res.Miss {
+			t.Fatalf("Get(%s) = %+v, %v, want a miss", actionID, res, err)
+		}
+		if _, err := c.Put(ctx, actionID, outputID, int64(len(body)), bytes.NewReader(body)); err != nil {
+			t.Fatal(err)
+		}
+		if res, err := c.Get(ctx, actionID); err != nil || res.Miss {
+			t.Fatalf("Get(%s) after put = %+v, %v, want a hit", actionID, res, err)
+		}
+	}
+	if err := c.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("RunIO() = %v", err)
+	}
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := Read(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3*n+1 {
+		t.Fatalf("recorded %d entries, want %d", len(entries), 3*n+1)
+	}
+	if e := entries[4]; e.Command != wire.CmdPut || e.BodySize != 64 || e.Body != nil {
+		t.Errorf("recorded put = %+v, want a put of 64 bytes without body", e)
+	}
+
+	// Replaying concurrently against an empty cache has the recorded hits & misses every time
+	for range 10 {
+		c, done := connect(t, slowPutProcess(t))
+		res, err := Replay(ctx, c, entries, 16)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := <-done; err != nil {
+			t.Fatalf("RunIO() = %v", err)
+		}
+
+		if res.Requests != 3*n || res.Hits != n || res.Misses != n || res.Errors != 0 {
+			t.Fatalf("Replay() = %+v, want %d hits & %d misses", res, n, n)
+		}
+	}
+}
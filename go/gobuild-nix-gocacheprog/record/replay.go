@@ -0,0 +1,198 @@
+package record
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/adisbladis/gobuild.nix/go/gobuild-nix-gocacheprog/cacheproc/client"
+	"github.com/adisbladis/gobuild.nix/go/gobuild-nix-gocacheprog/wire"
+)
+
+// Latency summarises the durations of one kind of request.
+type Latency struct {
+	Count int           `json:"count"`
+	P50   time.Duration `json:"p50"`
+	P90   time.Duration `json:"p90"`
+	P99   time.Duration `json:"p99"`
+	Max   time.Duration `json:"max"`
+}
+
+func newLatency(durations []time.Duration) Latency {
+	if len(durations) == 0 {
+		return Latency{}
+	}
+	slices.Sort(durations)
+
+	pct := func(p int) time.Duration {
+		return durations[(len(durations)-1)*p/100]
+	}
+	return Latency{
+		Count: len(durations),
+		P50:   pct(50),
+		P90:   pct(90),
+		P99:   pct(99),
+		Max:   durations[len(durations)-1],
+	}
+}
+
+// Result of replaying a recording.
+type Result struct {
+	Requests int           `json:"requests"`
+	Duration time.Duration `json:"duration"`
+
+	Hits      int           `json:"hits"`
+	Misses    int           `json:"misses"`
+	Errors    int           `json:"errors"`
+	PutBytes  int64         `json:"putBytes"`
+	CloseTime time.Duration `json:"closeTime"`
+
+	Get Latency `json:"get"`
+	Put Latency `json:"put"`
+}
+
+// HitRate is the fraction of gets served from the cache.
+func (r *Result) HitRate() float64 {
+	if gets := r.Hits + r.Misses; gets > 0 {
+		return float64(r.Hits) / float64(gets)
+	}
+	return 0
+}
+
+// Throughput is the number of requests handled per second.
+func (r *Result) Throughput() float64 {
+	if r.Duration > 0 {
+		return float64(r.Requests) / r.Duration.Seconds()
+	}
+	return 0
+}
+
+// syntheticBody stands in for a recorded put body.
+// It repeats the recorded OutputID, so identical outputs stay identical.
+type syntheticBody struct {
+	pattern []byte
+	off     int
+}
+
+func (b *syntheticBody) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		c := copy(p[n:], b.pattern[b.off:])
+		n += c
+		b.off = (b.off + c) % len(b.pattern)
+	}
+	return n, nil
+}
+
+func newSyntheticBody(e *Entry) io.Reader {
+	pattern := e.OutputID
+	if len(pattern) == 0 {
+		pattern = []byte{0}
+	}
+	return io.LimitReader(&syntheticBody{pattern: pattern}, e.BodySize)
+}
+
+// Replay sends all entries to c in recorded order with up to concurrency
+// requests in flight, then closes c.
+// Requests of several recorded cache processes are replayed as a single session.
+// Requests of the same action wait for the previous one to be answered,
+// so gets see earlier puts & hit rates are the same as when recording.
+//
+// Put bodies are replaced by synthetic data of the recorded size, the OutputID
+// is recomputed to match it.
+func Replay(ctx context.Context, c *client.Client, entries []*Entry, concurrency int) (*Result, error) {
+	// Hash synthetic bodies up front so it's not part of the measurement
+	outputIDs := make(map[*Entry]string)
+	for _, e := range entries {
+		if e.Command != wire.CmdPut {
+			continue
+		}
+		h := sha256.New()
+		io.Copy(h, newSyntheticBody(e))
+		outputIDs[e] = fmt.Sprintf("%x", h.Sum(nil))
+	}
+
+	res := &Result{}
+	var mu sync.Mutex // guards res & latencies
+	var gets, puts []time.Duration
+
+	sem := make(chan struct{}, max(concurrency, 1))
+	var wg sync.WaitGroup
+
+	// Closed once the last request of an action was answered
+	last := make(map[string]chan struct{})
+
+	start := time.Now()
+	for _, e := range entries {
+		// Close is sent once all other requests were answered, like cmd/go
+		if e.Command != wire.CmdGet && e.Command != wire.CmdPut {
+			continue
+		}
+
+		actionID := fmt.Sprintf("%x", e.ActionID)
+		prev := last[actionID]
+		done := make(chan struct{})
+		last[actionID] = done
+
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			defer close(done)
+
+			// The previous request holds a slot already, so waiting for it can't deadlock
+			if prev != nil {
+				<-prev
+			}
+			reqStart := time.Now()
+
+			switch e.Command {
+			case wire.CmdGet:
+				r, err := c.Get(ctx, actionID)
+				d := time.Since(reqStart)
+
+				mu.Lock()
+				defer mu.Unlock()
+				gets = append(gets, d)
+				switch {
+				case err != nil:
+					res.Errors++
+				case r.Miss:
+					res.Misses++
+				default:
+					res.Hits++
+				}
+
+			case wire.CmdPut:
+				_, err := c.Put(ctx, actionID, outputIDs[e], e.BodySize, newSyntheticBody(e))
+				d := time.Since(reqStart)
+
+				mu.Lock()
+				defer mu.Unlock()
+				puts = append(puts, d)
+				if err != nil {
+					res.Errors++
+				} else {
+					res.PutBytes += e.BodySize
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	closeStart := time.Now()
+	err := c.Close(ctx)
+	res.CloseTime = time.Since(closeStart)
+	res.Duration = time.Since(start)
+
+	res.Requests = len(gets) + len(puts)
+	res.Get = newLatency(gets)
+	res.Put = newLatency(puts)
+
+	return res, err
+}
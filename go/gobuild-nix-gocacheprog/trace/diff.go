@@ -0,0 +1,88 @@
+package trace
+
+import (
+	"maps"
+	"slices"
+)
+
+// Result of the gets of an action within a single trace
+type actionResult struct {
+	Hit      bool
+	OutputID string
+	Dir      string
+}
+
+// Summarise gets by actionID, an action counts as a hit if any get hit
+func getResults(records []*Record) map[string]*actionResult {
+	results := make(map[string]*actionResult)
+	for _, r := range records {
+		if r.Op != OpGet {
+			continue
+		}
+
+		res, ok := results[r.ActionID]
+		if !ok {
+			res = &actionResult{}
+			results[r.ActionID] = res
+		}
+		if r.Hit && !res.Hit {
+			res.Hit = true
+			res.OutputID = r.OutputID
+			res.Dir = r.Dir
+		}
+	}
+	return results
+}
+
+// DiffEntry is an action whose get result differs between two traces.
+type DiffEntry struct {
+	ActionID string
+
+	// Whether the action was requested & hit in each trace
+	InA, InB   bool
+	HitA, HitB bool
+
+	// Serving directories of hits
+	DirA, DirB string
+}
+
+// Diff lines up the gets of two traces & returns the actions that hit in one trace but not the other,
+// as well as actions only requested in one of them, sorted by actionID.
+func Diff(a, b []*Record) []*DiffEntry {
+	resultsA := getResults(a)
+	resultsB := getResults(b)
+
+	actionIDs := slices.Collect(maps.Keys(resultsA))
+	for actionID := range resultsB {
+		if _, ok := resultsA[actionID]; !ok {
+			actionIDs = append(actionIDs, actionID)
+		}
+	}
+	slices.Sort(actionIDs)
+
+	var diff []*DiffEntry
+	for _, actionID := range actionIDs {
+		ra, inA := resultsA[actionID]
+		rb, inB := resultsB[actionID]
+
+		e := &DiffEntry{
+			ActionID: actionID,
+			InA:      inA,
+			InB:      inB,
+		}
+		if inA {
+			e.HitA, e.DirA = ra.Hit, ra.Dir
+		}
+		if inB {
+			e.HitB, e.DirB = rb.Hit, rb.Dir
+		}
+
+		if inA && inB && e.HitA == e.HitB {
+			continue
+		}
+
+		diff = append(diff, e)
+	}
+
+	return diff
+}
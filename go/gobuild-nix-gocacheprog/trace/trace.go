@@ -0,0 +1,169 @@
+// Package trace records cache operations for diagnosing cache misses across builds.
+//
+// Traces are JSON lines files with one Record per get or put.
+// A build runs cmd/go several times, so records of each cache process are appended to the same trace.
+package trace
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/adisbladis/gobuild.nix/go/gobuild-nix-gocacheprog/cachers"
+)
+
+// Op is the kind of cache operation traced.
+type Op string
+
+const (
+	OpGet = Op("get")
+	OpPut = Op("put")
+)
+
+// Record is a single traced cache operation.
+type Record struct {
+	Op       Op     `json:"op"`
+	ActionID string `json:"a"`
+	OutputID string `json:"o,omitempty"`
+
+	// Whether a get was served from the cache
+	Hit bool `json:"hit,omitempty"`
+
+	// Cache directory storing the output, for gets this is the directory serving the hit.
+	// Store paths are recorded without the store directory & hash.
+	Dir string `json:"dir,omitempty"`
+
+	// Size of the output in bytes
+	Size int64 `json:"n,omitempty"`
+
+	// Start of the operation relative to the start of the cache process & its duration
+	Start    time.Duration `json:"s"`
+	Duration time.Duration `json:"d"`
+
+	Err string `json:"err,omitempty"`
+}
+
+// Cacher wraps a cachers.Cacher & records all gets & puts.
+type Cacher struct {
+	cachers.Cacher
+
+	start time.Time
+
+	mu sync.Mutex
+	f  *os.File
+	bw *bufio.Writer
+	je *json.Encoder
+}
+
+var _ cachers.Cacher = (*Cacher)(nil)
+
+// New creates a tracing wrapper around c appending records to path.
+func New(c cachers.Cacher, path string) (*Cacher, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	bw := bufio.NewWriter(f)
+	return &Cacher{
+		Cacher: c,
+		start:  time.Now(),
+		f:      f,
+		bw:     bw,
+		je:     json.NewEncoder(bw),
+	}, nil
+}
+
+func (t *Cacher) record(r *Record, start time.Time, err error) {
+	r.Start = start.Sub(t.start)
+	r.Duration = time.Since(start)
+	if err != nil {
+		r.Err = err.Error()
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.je.Encode(r)
+}
+
+func (t *Cacher) Get(ctx context.Context, actionID string) (outputID, diskPath string, err error) {
+	start := time.Now()
+	outputID, diskPath, dir, err := cachers.GetDir(ctx, t.Cacher, actionID)
+
+	r := &Record{
+		Op:       OpGet,
+		ActionID: actionID,
+		OutputID: outputID,
+		Hit:      outputID != "",
+	}
+	if r.Hit {
+		r.Dir = cachers.StoreName(dir)
+		if fi, err := os.Stat(diskPath); err == nil {
+			r.Size = fi.Size()
+		}
+	}
+	t.record(r, start, err)
+
+	return outputID, diskPath, err
+}
+
+func (t *Cacher) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) (diskPath string, err error) {
+	start := time.Now()
+	diskPath, dir, err := cachers.PutDir(ctx, t.Cacher, actionID, outputID, size, body)
+
+	r := &Record{
+		Op:       OpPut,
+		ActionID: actionID,
+		OutputID: outputID,
+		Size:     size,
+	}
+	if dir != "" {
+		r.Dir = cachers.StoreName(dir)
+	}
+	t.record(r, start, err)
+
+	return diskPath, err
+}
+
+// Close closes the wrapped cache & flushes the trace.
+func (t *Cacher) Close() error {
+	err := t.Cacher.Close()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return errors.Join(err, t.bw.Flush(), t.f.Close())
+}
+
+// Read all records from a trace file.
+func Read(path string) ([]*Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []*Record
+	jd := json.NewDecoder(bufio.NewReader(f))
+	for {
+		r := &Record{}
+		if err := jd.Decode(r); err != nil {
+			if errors.Is(err, io.EOF) {
+				return records, nil
+			}
+			return nil, fmt.Errorf("error reading trace %s: %w", path, err)
+		}
+		records = append(records, r)
+	}
+}
@@ -0,0 +1,125 @@
+package trace
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/adisbladis/gobuild.nix/go/gobuild-nix-gocacheprog/cachers"
+)
+
+func testOutput(i int) ([]byte, string) {
+	// Large enough to be compressed
+	output := bytes.Repeat([]byte(fmt.Sprintf("output %d ", i)), 1<<10)
+	sum := sha256.Sum256(output)
+	return output, hex.EncodeToString(sum[:])
+}
+
+func testActionID(i int) string {
+	return fmt.Sprintf("%064x", i)
+}
+
+func TestCacherDirs(t *testing.T) {
+	ctx := context.Background()
+	store := t.TempDir()
+	t.Setenv("NIX_STORE", store)
+
+	// A compressed dependency cache in the store
+	inputDir := filepath.Join(store, "00000000000000000000000000000000-dep-gocache")
+	if err := os.Mkdir(inputDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	input := &cachers.DiskCache{Dir: inputDir, Compress: true}
+	output, outputID := testOutput(1)
+	if _, err := input.Put(ctx, testActionID(1), outputID, int64(len(output)), bytes.NewReader(output)); err != nil {
+		t.Fatal(err)
+	}
+	if err := input.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	outDir := filepath.Join(store, "11111111111111111111111111111111-pkg-gocache")
+	if err := os.Mkdir(outDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "cache.trace")
+	tc, err := New(&cachers.Tiered{
+		Write: &cachers.DiskCache{Dir: outDir, Compress: true},
+		Read:  []cachers.Cacher{&cachers.DirStore{Dirs: []string{inputDir}}},
+	}, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Hits of compressed outputs are decompressed elsewhere, but traced with the directory serving them
+	if gotID, diskPath, err := tc.Get(ctx, testActionID(1)); err != nil || gotID != outputID || filepath.Dir(diskPath) == inputDir {
+		t.Fatalf("Get() = %q, %q, %v, want a decompressed hit of %s", gotID, diskPath, err, outputID)
+	}
+	if gotID, _, err := tc.Get(ctx, testActionID(2)); err != nil || gotID != "" {
+		t.Fatalf("Get() = %q, %v, want a miss", gotID, err)
+	}
+	output2, outputID2 := testOutput(2)
+	if _, err := tc.Put(ctx, testActionID(2), outputID2, int64(len(output2)), bytes.NewReader(output2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := Read(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range records {
+		r.Start, r.Duration = 0, 0
+	}
+	want := []*Record{
+		{Op: OpGet, ActionID: testActionID(1), OutputID: outputID, Hit: true, Dir: "dep-gocache", Size: int64(len(output))},
+		{Op: OpGet, ActionID: testActionID(2)},
+		{Op: OpPut, ActionID: testActionID(2), OutputID: outputID2, Dir: "pkg-gocache", Size: int64(len(output2))},
+	}
+	if !reflect.DeepEqual(records, want) {
+		for _, r := range records {
+			t.Logf("got %+v", r)
+		}
+		t.Errorf("records don't match %+v", want)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	a := []*Record{
+		{Op: OpGet, ActionID: "hit-both", Hit: true, Dir: "dep"},
+		{Op: OpGet, ActionID: "miss-both"},
+		{Op: OpGet, ActionID: "hit-a", Hit: true, Dir: "dep"},
+		{Op: OpGet, ActionID: "only-a"},
+		// A later hit of the same action counts
+		{Op: OpGet, ActionID: "hit-b"},
+		{Op: OpPut, ActionID: "hit-b", Dir: "out"},
+		{Op: OpGet, ActionID: "hit-b", Hit: true, Dir: "out"},
+	}
+	b := []*Record{
+		{Op: OpGet, ActionID: "hit-both", Hit: true, Dir: "other"},
+		{Op: OpGet, ActionID: "miss-both"},
+		{Op: OpGet, ActionID: "hit-a"},
+		{Op: OpGet, ActionID: "hit-b", Hit: true, Dir: "dep"},
+		{Op: OpGet, ActionID: "only-b", Hit: true, Dir: "dep"},
+	}
+
+	want := []*DiffEntry{
+		{ActionID: "hit-a", InA: true, InB: true, HitA: true, DirA: "dep"},
+		{ActionID: "only-a", InA: true},
+		{ActionID: "only-b", InB: true, HitB: true, DirB: "dep"},
+	}
+	if got := Diff(a, b); !reflect.DeepEqual(got, want) {
+		for _, e := range got {
+			t.Logf("got %+v", e)
+		}
+		t.Errorf("Diff() doesn't match %+v", want)
+	}
+}
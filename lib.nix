@@ -8,16 +8,57 @@ let
     groupBy
     attrNames
     mapAttrs
+    hashFile
     ;
   lockSchemaVersion = 1;
 
+  # Hash of the fetcher expression as recorded in locks by gobuild-nix-generate
+  fetcherHash = hashFile "sha256" ./nix/fetchers/default.nix;
+
+  # Fail early if hashes were computed with a different Go version or fetcher,
+  # as fixed-output derivations would otherwise fail with confusing hash mismatches.
+  checkIdentity =
+    {
+      go,
+      goVersion,
+      fetcherHash',
+    }:
+    if goVersion != null && goVersion != go.version then
+      throw "gobuild-nix: lock was generated with Go ${goVersion} but Go ${go.version} is used, regenerate the lock with gobuild-nix-generate or use a matching Go"
+    else if fetcherHash' != null && fetcherHash' != fetcherHash then
+      throw "gobuild-nix: lock was generated with a different fetcher (${fetcherHash'}, expected ${fetcherHash}), regenerate the lock with gobuild-nix-generate"
+    else
+      true;
+
+  # Create a Go package set scope from an overlay of Go packages
+  mkGoScope =
+    {
+      go,
+      callPackage,
+      overlay,
+      # Go version & fetcher hash the package hashes were computed with
+      goVersion ? null,
+      fetcherHash ? null,
+    }:
+    assert checkIdentity {
+      inherit go goVersion;
+      fetcherHash' = fetcherHash;
+    };
+    (callPackage ./nix { inherit go; }).overrideScope overlay;
+
 in
 {
+  inherit mkGoScope;
+
   mkGoSet =
     {
       goLock,
       go,
       callPackage,
+      # Whether test-only dependencies should be built.
+      # When disabled test-only modules are still available in the module cache,
+      # but they're not compiled & don't propagate their own requirements.
+      doCheck ? false,
     }:
     let
       lockFile = if isAttrs goLock then goLock else fromTOML (readFile goLock);
@@ -79,6 +120,15 @@ in
         in
         {
           inherit cycles;
+
+          # Tools from go.mod tool directives
+          tools = mapAttrs (
+            goPackagePath: module:
+            final.mkGoTool {
+              inherit goPackagePath;
+              module = final.${module};
+            }
+          ) (lockFile.tools or { });
         }
         // mapAttrs (
           goPackagePath: locked:
@@ -88,32 +138,44 @@ in
               fetchers,
               hooks,
             }:
-            stdenv.mkDerivation {
-              name = goPackagePath;
-              inherit (locked) version;
-
-              src = fetchers.fetchModuleProxy {
-                inherit goPackagePath;
-                inherit (locked) version hash;
-              };
-
-              passthru = {
-                inherit cycles;
-                inherit cyclePkgs;
-              };
-
-              nativeBuildInputs = [
-                hooks.goModuleHook
-              ];
-
-              propagatedBuildInputs = map (depGoPackagePath: final.${depGoPackagePath} or null) (
-                locked.require or [ ]
-              );
+            let
+              testOnly = !doCheck && (locked.usage or "") == "test";
+            in
+            stdenv.mkDerivation (
+              {
+                name = goPackagePath;
+                inherit (locked) version;
 
-            }
+                src = fetchers.fetchModuleProxy {
+                  inherit goPackagePath;
+                  inherit (locked) version hash;
+                };
+
+                passthru = {
+                  inherit cycles;
+                  inherit cyclePkgs;
+                };
+
+                nativeBuildInputs = [
+                  hooks.goModuleHook
+                ];
+
+                propagatedBuildInputs =
+                  if testOnly then
+                    [ ]
+                  else
+                    map (depGoPackagePath: final.${depGoPackagePath} or null) (locked.require or [ ]);
+              }
+              // (if testOnly then { dontBuild = true; } else { })
+            )
           ) { })
         ) lockFile.locked;
 
     in
-    (callPackage ./nix { inherit go; }).overrideScope overlay';
+    mkGoScope {
+      inherit go callPackage;
+      overlay = overlay';
+      goVersion = lockFile.go or null;
+      fetcherHash = lockFile.fetcher or null;
+    };
 }
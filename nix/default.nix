@@ -13,6 +13,8 @@ let
         "fetchers"
         "hooks"
         "callPackage"
+        "mkGoTool"
+        "tools"
       ]
   );
 in
@@ -50,6 +52,34 @@ lib.makeScope newScope (
 
     hooks = callPackage ./hooks { };
 
+    # Build a tool binary from a Go package provided by a module in the set.
+    # Used for go.mod tool directives.
+    mkGoTool = callPackage (
+      {
+        stdenv,
+        hooks,
+      }:
+      {
+        goPackagePath,
+        module,
+      }:
+      stdenv.mkDerivation {
+        name = baseNameOf goPackagePath;
+
+        goInstallPackages = goPackagePath;
+
+        buildInputs = [
+          module
+        ];
+
+        nativeBuildInputs = [
+          hooks.goAppHook
+        ];
+
+        meta.mainProgram = baseNameOf goPackagePath;
+      }
+    ) { };
+
     # Go standard library.
     "std" = callPackage (
       {
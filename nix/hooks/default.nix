@@ -38,6 +38,16 @@ in
     } ./configure-go-cache.sh
   ) { };
 
+  goDevShellHook = callPackage (
+    { }:
+    makeSetupHook {
+      name = "go-dev-shell-hook";
+      substitutions = {
+        gocacheprog = lib.getExe gobuild-nix-gocacheprog;
+      };
+    } ./dev-shell-hook.sh
+  ) { };
+
   configureGo = callPackage (
     { }:
     makeSetupHook {
@@ -0,0 +1,6 @@
+# Use gobuild-nix-gocacheprog in development shells, so builds reuse the caches of the package set.
+# Nix builds configure the cache in goConfigureCache instead.
+if [ -n "${IN_NIX_SHELL-}" ] && [ -z "${dontUseGoDevShellCache-}" ]; then
+  export GOCACHEPROG=@gocacheprog@
+  export NIX_GOBUILD_CACHE_DEVSHELL=1
+fi
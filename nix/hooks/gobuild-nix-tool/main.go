@@ -336,6 +336,11 @@ func installGoCmd() error {
 		return err
 	}
 
+	// Install tools declared with go.mod tool directives using the "tool" meta-package
+	if os.Getenv("goInstallTools") != "" {
+		goPackagePaths = append(goPackagePaths, "tool")
+	}
+
 	var installFlags []string
 	value, ok := os.LookupEnv("goInstalllags")
 	if ok {